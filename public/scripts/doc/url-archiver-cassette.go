@@ -0,0 +1,222 @@
+// -----------------------------------------------------------------------------
+// File:          url-archiver-cassette.go
+// Description:   HTTP record/replay for URLArchiverV1. Every client the tool
+//                builds sends its requests through httpTransport; -record
+//                wraps it to save each request and response to a JSON
+//                cassette, and tests swap in a replayer that answers from one,
+//                so archiver behavior can be checked offline. Cassettes live
+//                in testdata/cassettes and may be edited by hand; delay_ms
+//                holds a response back to exercise timeouts.
+// Author:        Kris Yotam
+// License:       CC-0
+// -----------------------------------------------------------------------------
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// httpTransport carries every request defaultHTTPClient sends. Tests replace
+// it with a cassetteReplayer; -record wraps it in a cassetteRecorder.
+var httpTransport http.RoundTripper = http.DefaultTransport
+
+// redactedHeaders are never written to a cassette.
+var redactedHeaders = []string{"Authorization", "Cookie", "Set-Cookie"}
+
+// Interaction is one recorded request and what came back.
+type Interaction struct {
+	Request  RecordedRequest   `json:"request"`
+	Response *RecordedResponse `json:"response,omitempty"`
+	Error    string            `json:"error,omitempty"`    // transport error instead of a response
+	DelayMS  int               `json:"delay_ms,omitempty"` // replay: wait this long before answering
+}
+
+// RecordedRequest identifies a request; method and URL are what replay
+// matches on.
+type RecordedRequest struct {
+	Method string `json:"method"`
+	URL    string `json:"url"`
+	Body   string `json:"body,omitempty"`
+}
+
+// RecordedResponse is a response as replay serves it.
+type RecordedResponse struct {
+	Status  int         `json:"status"`
+	Headers http.Header `json:"headers,omitempty"`
+	Body    string      `json:"body,omitempty"`
+}
+
+// Cassette is an ordered list of interactions.
+type Cassette struct {
+	Interactions []Interaction `json:"interactions"`
+}
+
+func loadCassette(path string) (*Cassette, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var c Cassette
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &c, nil
+}
+
+func interactionKey(method, url string) string {
+	return method + " " + url
+}
+
+// -----------------------------------------------------------------------------
+// Recording
+// -----------------------------------------------------------------------------
+
+// cassetteRecorder passes requests to base and remembers each exchange.
+type cassetteRecorder struct {
+	base http.RoundTripper
+
+	mu       sync.Mutex
+	cassette Cassette
+}
+
+func newCassetteRecorder(base http.RoundTripper) *cassetteRecorder {
+	return &cassetteRecorder{base: base}
+}
+
+func (r *cassetteRecorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	in := Interaction{Request: RecordedRequest{Method: req.Method, URL: req.URL.String()}}
+	if req.Body != nil && req.GetBody != nil {
+		if body, err := req.GetBody(); err == nil {
+			data, _ := io.ReadAll(body)
+			body.Close()
+			in.Request.Body = string(data)
+		}
+	}
+	resp, err := r.base.RoundTrip(req)
+	if err != nil {
+		in.Error = err.Error()
+		r.add(in)
+		return nil, err
+	}
+	data, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(data))
+	headers := resp.Header.Clone()
+	for _, h := range redactedHeaders {
+		headers.Del(h)
+	}
+	in.Response = &RecordedResponse{Status: resp.StatusCode, Headers: headers, Body: string(data)}
+	r.add(in)
+	return resp, nil
+}
+
+func (r *cassetteRecorder) add(in Interaction) {
+	r.mu.Lock()
+	r.cassette.Interactions = append(r.cassette.Interactions, in)
+	r.mu.Unlock()
+}
+
+// Save writes everything recorded so far to path.
+func (r *cassetteRecorder) Save(path string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	data, err := json.MarshalIndent(r.cassette, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// -----------------------------------------------------------------------------
+// Replay
+// -----------------------------------------------------------------------------
+
+// errCassetteMiss is returned for a request the cassette has no answer for.
+var errCassetteMiss = errors.New("cassette: no recorded interaction")
+
+// cassetteReplayer answers requests from a cassette. Interactions for the
+// same method and URL are served in recorded order, each once.
+type cassetteReplayer struct {
+	mu      sync.Mutex
+	pending map[string][]Interaction
+}
+
+func newCassetteReplayer(c *Cassette) *cassetteReplayer {
+	p := &cassetteReplayer{pending: make(map[string][]Interaction)}
+	for _, in := range c.Interactions {
+		key := interactionKey(strings.ToUpper(in.Request.Method), in.Request.URL)
+		p.pending[key] = append(p.pending[key], in)
+	}
+	return p
+}
+
+func (p *cassetteReplayer) RoundTrip(req *http.Request) (*http.Response, error) {
+	key := interactionKey(req.Method, req.URL.String())
+	p.mu.Lock()
+	queue := p.pending[key]
+	if len(queue) == 0 {
+		p.mu.Unlock()
+		return nil, fmt.Errorf("%w for %s", errCassetteMiss, key)
+	}
+	in := queue[0]
+	p.pending[key] = queue[1:]
+	p.mu.Unlock()
+	if req.Body != nil {
+		req.Body.Close()
+	}
+
+	if in.DelayMS > 0 {
+		t := time.NewTimer(time.Duration(in.DelayMS) * time.Millisecond)
+		defer t.Stop()
+		select {
+		case <-t.C:
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+	if in.Error != "" || in.Response == nil {
+		return nil, errors.New(in.Error)
+	}
+	header := in.Response.Headers.Clone()
+	if header == nil {
+		header = make(http.Header)
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", in.Response.Status, http.StatusText(in.Response.Status)),
+		StatusCode:    in.Response.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(strings.NewReader(in.Response.Body)),
+		ContentLength: int64(len(in.Response.Body)),
+		Request:       req,
+	}, nil
+}
+
+// Unused lists the interactions no request asked for, so tests can tell
+// when the code under test stopped making a call the cassette expects.
+func (p *cassetteReplayer) Unused() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var out []string
+	for key, queue := range p.pending {
+		for range queue {
+			out = append(out, key)
+		}
+	}
+	return out
+}
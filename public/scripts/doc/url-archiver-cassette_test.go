@@ -0,0 +1,56 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func TestCassetteRecordThenReplay(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Set-Cookie", "session=secret")
+		w.Header().Set("Content-Location", "/web/20261017093012/https://example.com/essay")
+		w.WriteHeader(http.StatusCreated)
+		io.WriteString(w, "saved "+r.URL.Path)
+	}))
+	defer srv.Close()
+
+	rec := newCassetteRecorder(http.DefaultTransport)
+	client := &http.Client{Transport: rec}
+	get := func(c *http.Client) (int, string, http.Header) {
+		t.Helper()
+		resp, err := c.Get(srv.URL + "/save/https://example.com/essay")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body), resp.Header
+	}
+	status, body, _ := get(client)
+
+	path := filepath.Join(t.TempDir(), "cassette.json")
+	if err := rec.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	c, err := loadCassette(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replay := newCassetteReplayer(c)
+	gotStatus, gotBody, header := get(&http.Client{Transport: replay})
+	if gotStatus != status || gotBody != body {
+		t.Errorf("replayed %d %q, recorded %d %q", gotStatus, gotBody, status, body)
+	}
+	if header.Get("Content-Location") == "" {
+		t.Error("Content-Location was not recorded")
+	}
+	if header.Get("Set-Cookie") != "" {
+		t.Error("Set-Cookie should be redacted from cassettes")
+	}
+	if unused := replay.Unused(); len(unused) != 0 {
+		t.Errorf("unused interactions: %v", unused)
+	}
+}
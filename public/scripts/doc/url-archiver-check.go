@@ -0,0 +1,385 @@
+// -----------------------------------------------------------------------------
+// File:          url-archiver-check.go
+// Description:   Dead-link checker mode for URLArchiverV1 ("check"). Probes each
+//                cited URL with HEAD then GET, records the redirect chain and
+//                classifies the outcome so broken citations surface before we
+//                spend archive requests on them.
+// Author:        Kris Yotam
+// License:       CC-0
+// -----------------------------------------------------------------------------
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// Link states recorded in CheckResult.Status.
+const (
+	linkOK         = "ok"
+	linkRedirected = "redirected"
+	link404        = "404"
+	link410        = "410"
+	linkSoft404    = "soft-404"
+	linkTLS        = "tls-error"
+	linkDNS        = "dns-failure"
+	linkTimeout    = "timeout"
+	linkHTTPError  = "http-error"
+	linkError      = "error"
+	linkRobots     = "robots-disallowed" // not fetched: robots.txt rules it out
+)
+
+// maxRedirects bounds how far checkURL follows a redirect chain.
+const maxRedirects = 10
+
+// maxCheckBody is how much of a GET body is read when looking for soft 404s.
+const maxCheckBody = 64 << 10
+
+// CheckResult is the outcome of probing one URL.
+type CheckResult struct {
+	URL        string
+	Status     string
+	HTTPStatus int
+	Method     string   // HEAD or GET, whichever produced the verdict
+	Redirects  []string // every hop after URL, in order
+	FinalURL   string
+	MediaType  string // Content-Type of the final response, without parameters
+	Duration   time.Duration
+	Error      error
+}
+
+// Broken reports whether the URL should be treated as dead. URLs robots.txt
+// kept us from probing are neither broken nor working.
+func (c CheckResult) Broken() bool {
+	return c.Status != linkOK && c.Status != linkRedirected && c.Status != linkRobots
+}
+
+// softNotFoundRegex matches <title> text and final paths typical of pages
+// that answer 200 but really mean "not found".
+var (
+	softNotFoundTitle = regexp.MustCompile(`(?is)<title[^>]*>[^<]*(404|not found|page not found|doesn.t exist|no longer available)[^<]*</title>`)
+	softNotFoundPath  = regexp.MustCompile(`(?i)(^|/)(404|not-?found|page-not-found|error)(\.html?)?/?$`)
+)
+
+// checkURL probes target with HEAD, falling back to GET when HEAD is refused
+// or fails, since many servers mishandle HEAD. Every request waits its turn
+// on hosts.
+func checkURL(ctx context.Context, client *http.Client, hosts *hostLimiter, target string) CheckResult {
+	start := time.Now()
+	res := probe(ctx, client, hosts, http.MethodHead, target)
+	switch {
+	case res.Error != nil || res.HTTPStatus >= 400:
+		res = probe(ctx, client, hosts, http.MethodGet, target)
+	case res.Status != linkSoft404 && isHTML(res.MediaType):
+		// A HEAD cannot see a "not found" title, so fetch the start of the
+		// page. If the GET fails where HEAD worked, the HEAD verdict stands.
+		if get := probe(ctx, client, hosts, http.MethodGet, target); get.Error == nil {
+			res = get
+		}
+	}
+	res.Duration = time.Since(start)
+	return res
+}
+
+// probe issues method against target, following redirects by hand so every
+// hop is recorded, and classifies the final response.
+func probe(ctx context.Context, client *http.Client, hosts *hostLimiter, method, target string) CheckResult {
+	res := CheckResult{URL: target, Method: method}
+	nc := noRedirectClient(client)
+	current := target
+	for hop := 0; ; hop++ {
+		if err := hosts.Wait(ctx, current); err != nil {
+			res.Status, res.Error = linkError, err
+			return res
+		}
+		req, err := http.NewRequestWithContext(ctx, method, current, nil)
+		if err != nil {
+			res.Status, res.Error = linkError, err
+			return res
+		}
+		resp, err := nc.Do(req)
+		if err != nil {
+			res.Status, res.Error = classifyError(err), err
+			return res
+		}
+		var body []byte
+		if method == http.MethodGet {
+			body, _ = io.ReadAll(io.LimitReader(resp.Body, maxCheckBody))
+		}
+		resp.Body.Close()
+		res.HTTPStatus = resp.StatusCode
+
+		if loc := resp.Header.Get("Location"); resp.StatusCode >= 300 && resp.StatusCode < 400 && loc != "" {
+			if hop >= maxRedirects {
+				res.Status, res.Error = linkError, fmt.Errorf("more than %d redirects", maxRedirects)
+				return res
+			}
+			next, err := req.URL.Parse(loc)
+			if err != nil {
+				res.Status, res.Error = linkError, fmt.Errorf("bad redirect %q: %w", loc, err)
+				return res
+			}
+			current = next.String()
+			res.Redirects = append(res.Redirects, current)
+			continue
+		}
+
+		res.FinalURL = current
+		res.MediaType, _, _ = mime.ParseMediaType(resp.Header.Get("Content-Type"))
+		res.Status = classifyResponse(target, current, resp.StatusCode, body)
+		return res
+	}
+}
+
+// classifyResponse maps the final status (and, for GET, the start of the
+// body) to a link state.
+func classifyResponse(target, final string, status int, body []byte) string {
+	switch {
+	case status == http.StatusNotFound:
+		return link404
+	case status == http.StatusGone:
+		return link410
+	case status >= 400:
+		return linkHTTPError
+	}
+	if looksSoft404(target, final, body) {
+		return linkSoft404
+	}
+	if final != target {
+		return linkRedirected
+	}
+	return linkOK
+}
+
+// isHTML reports whether a media type is a web page a soft 404 could hide in.
+func isHTML(mediaType string) bool {
+	return mediaType == "text/html" || mediaType == "application/xhtml+xml"
+}
+
+// looksSoft404 flags 2xx answers that are really "not found": a deep link
+// redirected to the site root or to an error path, or a not-found title.
+func looksSoft404(target, final string, body []byte) bool {
+	tu, err1 := url.Parse(target)
+	fu, err2 := url.Parse(final)
+	if err1 == nil && err2 == nil && final != target {
+		if strings.Trim(tu.Path, "/") != "" && strings.Trim(fu.Path, "/") == "" {
+			return true
+		}
+		if softNotFoundPath.MatchString(fu.Path) && !softNotFoundPath.MatchString(tu.Path) {
+			return true
+		}
+	}
+	return len(body) > 0 && softNotFoundTitle.Match(body)
+}
+
+// classifyError maps transport errors to DNS, TLS and timeout states.
+func classifyError(err error) string {
+	var dnsErr *net.DNSError
+	var certErr *tls.CertificateVerificationError
+	var unknownAuth x509.UnknownAuthorityError
+	var hostErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+	var recordErr tls.RecordHeaderError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &dnsErr):
+		return linkDNS
+	case errors.As(err, &certErr), errors.As(err, &unknownAuth), errors.As(err, &hostErr),
+		errors.As(err, &invalidErr), errors.As(err, &recordErr):
+		return linkTLS
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return linkTimeout
+	}
+	return linkError
+}
+
+// checkURLs probes urls concurrently, respecting the per-host rate limit and
+// robots.txt.
+func checkURLs(ctx context.Context, guard *fetchGuard, urls []string, concurrency int) []CheckResult {
+	eg, egCtx := errgroup.WithContext(ctx)
+	eg.SetLimit(concurrency)
+	var mu sync.Mutex
+	results := make([]CheckResult, 0, len(urls))
+	for _, u := range urls {
+		u := u
+		if egCtx.Err() != nil {
+			break
+		}
+		eg.Go(func() error {
+			var res CheckResult
+			if !guard.robots.Allowed(egCtx, u) {
+				res = CheckResult{URL: u, Status: linkRobots, Error: errRobotsDisallowed}
+			} else {
+				res = checkURL(egCtx, guard.client, guard.hosts, u)
+			}
+			if egCtx.Err() != nil {
+				return nil
+			}
+			mu.Lock()
+			results = append(results, res)
+			mu.Unlock()
+			return nil
+		})
+	}
+	eg.Wait()
+	sort.Slice(results, func(i, j int) bool { return results[i].URL < results[j].URL })
+	return results
+}
+
+// runCheck is the "check" mode: probe every cited URL and report which
+// content links to each broken one.
+func runCheck(ctx context.Context, cfg config) {
+	set, err := gatherRefs(cfg)
+	if err != nil {
+		log.Fatalf("Failed to collect URLs: %v", err)
+	}
+	urls := uniqueURLs(set.Refs)
+	fmt.Printf("Checking %d URLs\n", len(urls))
+
+	guard := newFetchGuard(cfg)
+	results := checkURLs(ctx, guard, urls, cfg.Concurrency)
+
+	ledger, err := openLedger(cfg.LedgerPath)
+	if err != nil {
+		log.Fatalf("Failed to open ledger: %v", err)
+	}
+	defer ledger.Close()
+	now := time.Now()
+	for _, r := range results {
+		if r.Status == linkRobots {
+			continue // no verdict, so leave the broken streak alone
+		}
+		if err := ledger.RecordCheck(r, now); err != nil {
+			log.Printf("Ledger write error %s: %v", r.URL, err)
+		}
+	}
+
+	var drift []DriftResult
+	if tracked := driftTracked(set.Refs, cfg.Drift); len(tracked) > 0 && ctx.Err() == nil {
+		drift = checkDrift(ctx, cfg, guard, ledger, results, tracked)
+	}
+
+	writeCheckReport(cfg.ReportPath, results, drift, set.Excluded, cfg.DriftThreshold, refsByURL(set.Refs))
+	broken := 0
+	for _, r := range results {
+		if r.Broken() {
+			broken++
+		}
+	}
+	if ctx.Err() != nil {
+		fmt.Printf("Interrupted after %d of %d URLs. ", len(results), len(urls))
+	}
+	drifted := 0
+	for _, d := range drift {
+		if d.Drifted(cfg.DriftThreshold) {
+			drifted++
+		}
+	}
+	fmt.Printf("Check complete: %d broken, %d drifted of %d. Report: %s\n", broken, drifted, len(results), cfg.ReportPath)
+}
+
+// writeCheckReport lists every result, then the broken ones with the content
+// slugs (and citations) that link to them, then pages whose text drifted
+// from what we archived, then the URLs -policy or robots.txt kept us from
+// checking.
+func writeCheckReport(path string, results []CheckResult, drift []DriftResult, excluded []Exclusion, threshold float64, sources map[string][]URLRef) {
+	f, err := os.Create(path)
+	if err != nil {
+		log.Fatalf("Report create error: %v", err)
+	}
+	defer f.Close()
+
+	counts := make(map[string]int)
+	for _, r := range results {
+		counts[r.Status]++
+		f.WriteString(fmt.Sprintf("%s [%s] status=%d method=%s time=%s", r.URL, r.Status, r.HTTPStatus, r.Method, r.Duration.Round(time.Millisecond)))
+		if r.Error != nil {
+			f.WriteString(fmt.Sprintf(" error=%v", r.Error))
+		}
+		f.WriteString("\n")
+		for _, hop := range r.Redirects {
+			f.WriteString(fmt.Sprintf("    -> %s\n", hop))
+		}
+	}
+
+	f.WriteString("\n# broken links by source\n")
+	for _, r := range results {
+		if !r.Broken() {
+			continue
+		}
+		f.WriteString(fmt.Sprintf("%s [%s]\n", r.URL, r.Status))
+		seen := make(map[string]bool)
+		for _, src := range sources[r.URL] {
+			key := src.Type + "/" + src.Slug + "\x00" + src.File
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			line := fmt.Sprintf("    %s/%s (%s:%d)", src.Type, src.Slug, src.File, src.Line)
+			if src.Citation != nil {
+				line += " " + src.Citation.String()
+			}
+			f.WriteString(line + "\n")
+		}
+	}
+
+	f.WriteString("\n# drifted since archived\n")
+	for _, d := range drift {
+		if d.Error != nil {
+			f.WriteString(fmt.Sprintf("%s [drift unknown] error=%v\n", d.URL, d.Error))
+			continue
+		}
+		if !d.Drifted(threshold) {
+			continue
+		}
+		f.WriteString(fmt.Sprintf("%s similarity=%.2f baseline=%s\n", d.URL, d.Similarity, d.BaselineAt.Format(ledgerTimeLayout)))
+		for _, src := range sources[d.URL] {
+			line := fmt.Sprintf("    %s/%s (%s:%d)", src.Type, src.Slug, src.File, src.Line)
+			if src.Citation != nil {
+				line += " " + src.Citation.String()
+			}
+			f.WriteString(line + "\n")
+		}
+	}
+
+	f.WriteString("\n# skipped by policy\n")
+	for _, e := range excluded {
+		f.WriteString(fmt.Sprintf("%s [excluded] because=%s\n", e.URL, e.Reason))
+	}
+	for _, r := range results {
+		if r.Status == linkRobots {
+			f.WriteString(fmt.Sprintf("%s [%s]\n", r.URL, linkRobots))
+		}
+	}
+
+	states := make([]string, 0, len(counts))
+	for s := range counts {
+		states = append(states, s)
+	}
+	sort.Strings(states)
+	f.WriteString("\n")
+	for _, s := range states {
+		f.WriteString(fmt.Sprintf("# %s: %d\n", s, counts[s]))
+	}
+	if len(excluded) > 0 {
+		f.WriteString(fmt.Sprintf("# excluded: %d URLs refused by policy\n", len(excluded)))
+	}
+}
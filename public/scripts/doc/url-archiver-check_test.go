@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCheckURLSoft404BehindHead(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/gone", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		io.WriteString(w, "<html><title>Page Not Found</title></html>")
+	})
+	mux.HandleFunc("/paper.pdf", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodHead {
+			t.Errorf("%s %s: a PDF should not be fetched", r.Method, r.URL.Path)
+		}
+		w.Header().Set("Content-Type", "application/pdf")
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	res := checkURL(context.Background(), srv.Client(), nil, srv.URL+"/gone")
+	if res.Status != linkSoft404 || res.Method != http.MethodGet {
+		t.Errorf("/gone = %s by %s, want %s by GET", res.Status, res.Method, linkSoft404)
+	}
+	res = checkURL(context.Background(), srv.Client(), nil, srv.URL+"/paper.pdf")
+	if res.Status != linkOK || res.Method != http.MethodHead {
+		t.Errorf("/paper.pdf = %s by %s, want %s by HEAD", res.Status, res.Method, linkOK)
+	}
+}
+
+func TestCheckURLPacesFollowUpGet(t *testing.T) {
+	const delay = 50 * time.Millisecond
+	var mu sync.Mutex
+	var at []time.Time
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		at = append(at, time.Now())
+		mu.Unlock()
+		w.Header().Set("Content-Type", "text/html")
+		io.WriteString(w, "<html><title>An essay</title></html>")
+	}))
+	defer srv.Close()
+
+	// An HTML page is fetched twice, HEAD then GET, and the GET must wait
+	// out the host's spacing like any other request.
+	res := checkURL(context.Background(), srv.Client(), newHostLimiter(float64(time.Second/delay)), srv.URL+"/essay")
+	if res.Status != linkOK || res.Method != http.MethodGet {
+		t.Fatalf("/essay = %s by %s, want %s by GET", res.Status, res.Method, linkOK)
+	}
+	if len(at) != 2 {
+		t.Fatalf("got %d requests, want HEAD and GET", len(at))
+	}
+	if gap := at[1].Sub(at[0]); gap < delay*9/10 {
+		t.Errorf("GET came %v after HEAD, want at least %v", gap, delay)
+	}
+}
@@ -0,0 +1,170 @@
+// -----------------------------------------------------------------------------
+// File:          url-archiver-citations.go
+// Description:   Schema-aware parsing of bibliography.json and margin-notes.json
+//                for URLArchiverV1, so every URL is attributed to the citation
+//                or margin note it belongs to. Mirrors the BibliographyEntry
+//                and MarginNote types in src/lib/mdx.ts.
+// Author:        Kris Yotam
+// License:       CC-0
+// -----------------------------------------------------------------------------
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+)
+
+// Kinds of link recorded in URLRef.Kind for structured JSON sources.
+const (
+	refBibliography = "bibliography"
+	refMarginNote   = "margin-note"
+)
+
+// BibliographyEntry is one entry of a post's bibliography.json.
+type BibliographyEntry struct {
+	ID        string `json:"id"`
+	Author    string `json:"author"`
+	Title     string `json:"title"`
+	Year      any    `json:"year"` // number in most files, occasionally a string
+	Publisher string `json:"publisher"`
+	URL       string `json:"url"`
+	Type      string `json:"type"`
+}
+
+// MarginNote is one entry of a post's margin-notes.json.
+type MarginNote struct {
+	ID       string `json:"id"`
+	Title    string `json:"title"`
+	Content  string `json:"content"`
+	Index    int    `json:"index"`
+	Source   string `json:"source"`
+	Priority int    `json:"priority"`
+}
+
+// Citation identifies the bibliography entry or margin note a URL came from.
+type Citation struct {
+	Kind   string // refBibliography or refMarginNote
+	Key    string
+	Author string
+	Title  string
+}
+
+func (c *Citation) String() string {
+	switch {
+	case c.Author != "" && c.Title != "":
+		return fmt.Sprintf("%s[%s] %s, %q", c.Kind, c.Key, c.Author, c.Title)
+	case c.Title != "":
+		return fmt.Sprintf("%s[%s] %q", c.Kind, c.Key, c.Title)
+	default:
+		return fmt.Sprintf("%s[%s]", c.Kind, c.Key)
+	}
+}
+
+// scanJSON dispatches a JSON source file to its schema-aware scanner, falling
+// back to a plain URL scan for unknown files or ones that fail to decode.
+func scanJSON(file string, data []byte) []URLRef {
+	var refs []URLRef
+	var err error
+	switch filepath.Base(file) {
+	case "bibliography.json":
+		refs, err = scanBibliography(file, data)
+	case "margin-notes.json":
+		refs, err = scanMarginNotes(file, data)
+	default:
+		return scanBareURLs(file, data, refBare)
+	}
+	if err != nil {
+		log.Printf("Decode error %s: %v (falling back to plain scan)", file, err)
+		return scanBareURLs(file, data, refBare)
+	}
+	return refs
+}
+
+func scanBibliography(file string, data []byte) ([]URLRef, error) {
+	var refs []URLRef
+	err := decodeJSONArray(data, func(line int, raw json.RawMessage) error {
+		var e BibliographyEntry
+		if err := json.Unmarshal(raw, &e); err != nil {
+			return err
+		}
+		cite := &Citation{Kind: refBibliography, Key: e.ID, Author: e.Author, Title: e.Title}
+		if u := strings.TrimSpace(e.URL); isHTTPURL(u) {
+			refs = append(refs, URLRef{URL: u, File: file, Line: line + lineOf(raw, e.URL), Kind: refBibliography, Citation: cite})
+		}
+		return nil
+	})
+	return refs, err
+}
+
+func scanMarginNotes(file string, data []byte) ([]URLRef, error) {
+	var refs []URLRef
+	err := decodeJSONArray(data, func(line int, raw json.RawMessage) error {
+		var n MarginNote
+		if err := json.Unmarshal(raw, &n); err != nil {
+			return err
+		}
+		cite := &Citation{Kind: refMarginNote, Key: n.ID, Title: n.Title}
+		if u := strings.TrimSpace(n.Source); isHTTPURL(u) {
+			refs = append(refs, URLRef{URL: u, File: file, Line: line + lineOf(raw, n.Source), Kind: refMarginNote, Citation: cite})
+		}
+		// Note bodies are Markdown, so reuse the prose scanner on them.
+		for _, l := range strings.Split(n.Content, "\n") {
+			for _, r := range scanMarkdownLine(stripCodeSpans(l)) {
+				r.File = file
+				r.Line = line + lineOf(raw, r.URL)
+				r.Kind = refMarginNote
+				r.Citation = cite
+				refs = append(refs, r)
+			}
+		}
+		return nil
+	})
+	return refs, err
+}
+
+// decodeJSONArray calls fn for each element of a top-level JSON array with
+// the 1-based line the element starts on.
+func decodeJSONArray(data []byte, fn func(line int, raw json.RawMessage) error) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if d, ok := tok.(json.Delim); !ok || d != '[' {
+		return fmt.Errorf("expected a JSON array")
+	}
+	for dec.More() {
+		off := int(dec.InputOffset())
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return err
+		}
+		// InputOffset points just past the previous token; skip the comma
+		// and whitespace to find where this element really starts.
+		start := off + bytes.IndexFunc(data[off:], func(r rune) bool {
+			return r != ',' && r != ' ' && r != '\t' && r != '\n' && r != '\r'
+		})
+		if err := fn(1+bytes.Count(data[:start], []byte("\n")), raw); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lineOf returns how many lines into raw the first occurrence of s appears,
+// so URLs inside multi-line entries point at their own line.
+func lineOf(raw json.RawMessage, s string) int {
+	if s == "" {
+		return 0
+	}
+	i := bytes.Index(raw, []byte(s))
+	if i < 0 {
+		return 0
+	}
+	return bytes.Count(raw[:i], []byte("\n"))
+}
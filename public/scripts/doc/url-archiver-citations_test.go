@@ -0,0 +1,99 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func scanFixture(t *testing.T, path string) []URLRef {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return scanJSON(path, data)
+}
+
+func TestScanBibliography(t *testing.T) {
+	path := filepath.Join("testdata", "citations", "entries", "bibliography.json")
+	knuth := &Citation{Kind: refBibliography, Key: "knuth1974", Author: "Donald E. Knuth", Title: "Computer Programming as an Art"}
+	graham := &Citation{Kind: refBibliography, Key: "graham2004", Author: "Paul Graham", Title: "Hackers and Painters"}
+	untitled := &Citation{Kind: refBibliography, Key: "untitled"}
+	// Entries without a url, or with a non-http one, contribute nothing;
+	// a string year decodes as well as a numeric one.
+	want := []URLRef{
+		{URL: "https://dl.acm.org/doi/10.1145/361604.361612", File: path, Line: 8, Kind: refBibliography, Citation: knuth},
+		{URL: "http://paulgraham.com/hp.html", File: path, Line: 11, Kind: refBibliography, Citation: graham},
+		{URL: "https://example.com/untitled", File: path, Line: 28, Kind: refBibliography, Citation: untitled},
+	}
+	if got := scanFixture(t, path); !reflect.DeepEqual(got, want) {
+		t.Errorf("refs =\n%+v\nwant\n%+v", got, want)
+	}
+}
+
+func TestScanMarginNotes(t *testing.T) {
+	path := filepath.Join("testdata", "citations", "entries", "margin-notes.json")
+	tools := &Citation{Kind: refMarginNote, Key: "mn-1", Title: "On Tools"}
+	aside := &Citation{Kind: refMarginNote, Key: "mn-3"}
+	// The source comes first, then links in the Markdown content, skipping
+	// code spans.
+	want := []URLRef{
+		{URL: "https://example.com/source", File: path, Line: 7, Kind: refMarginNote, Citation: tools},
+		{URL: "https://example.com/tools", File: path, Line: 5, Kind: refMarginNote, Citation: tools},
+		{URL: "https://example.com/auto", File: path, Line: 13, Kind: refMarginNote, Citation: aside},
+		{URL: "https://example.com/bare", File: path, Line: 13, Kind: refMarginNote, Citation: aside},
+	}
+	if got := scanFixture(t, path); !reflect.DeepEqual(got, want) {
+		t.Errorf("refs =\n%+v\nwant\n%+v", got, want)
+	}
+}
+
+func TestScanJSONFallsBackOnBadSchema(t *testing.T) {
+	cases := []struct {
+		file string
+		want URLRef
+	}{
+		// Not a top-level array.
+		{"bibliography.json", URLRef{URL: "https://example.com/not-an-array", Line: 3, Kind: refBare}},
+		// An element that does not match MarginNote.
+		{"margin-notes.json", URLRef{URL: "https://example.com/bad-index", Line: 2, Kind: refBare}},
+	}
+	for _, c := range cases {
+		path := filepath.Join("testdata", "citations", "malformed", c.file)
+		c.want.File = path
+		if got := scanFixture(t, path); !reflect.DeepEqual(got, []URLRef{c.want}) {
+			t.Errorf("%s: refs = %+v, want the plain scan %+v", c.file, got, c.want)
+		}
+	}
+}
+
+func TestCitationString(t *testing.T) {
+	cases := []struct {
+		c    Citation
+		want string
+	}{
+		{Citation{Kind: refBibliography, Key: "knuth1974", Author: "Donald E. Knuth", Title: "Art"}, `bibliography[knuth1974] Donald E. Knuth, "Art"`},
+		{Citation{Kind: refMarginNote, Key: "mn-1", Title: "On Tools"}, `margin-note[mn-1] "On Tools"`},
+		{Citation{Kind: refMarginNote, Key: "mn-3", Author: "Nobody"}, `margin-note[mn-3]`},
+	}
+	for _, c := range cases {
+		if got := c.c.String(); got != c.want {
+			t.Errorf("String() = %s, want %s", got, c.want)
+		}
+	}
+}
+
+func TestExtractRefsAttributesCitations(t *testing.T) {
+	path := filepath.Join("testdata", "citations", "entries", "bibliography.json")
+	refs := extractRefs([]SourceFile{{Path: path, Type: "essays", Slug: "on-art"}})
+	if len(refs) != 3 {
+		t.Fatalf("got %d refs, want 3", len(refs))
+	}
+	for _, r := range refs {
+		if r.Type != "essays" || r.Slug != "on-art" || r.Citation == nil {
+			t.Errorf("%s: type %q slug %q citation %v, want essays/on-art with a citation", r.URL, r.Type, r.Slug, r.Citation)
+		}
+	}
+}
@@ -0,0 +1,216 @@
+// -----------------------------------------------------------------------------
+// File:          url-archiver-content.go
+// Description:   Content discovery for URLArchiverV1. Enumerates every content
+//                type and slug from public/data/content.db and resolves each to
+//                its MDX file and the bibliography / margin-note JSON beside it,
+//                following resolveMdxPath in src/lib/mdx.ts.
+// Author:        Kris Yotam
+// License:       CC-0
+// -----------------------------------------------------------------------------
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// nonContentTables hold taxonomy or uploads rather than MDX posts, even
+// though some of them have slug and state columns.
+var nonContentTables = map[string]bool{
+	"categories": true,
+	"tags":       true,
+	"sequences":  true,
+	"documents":  true,
+}
+
+// ContentItem is one row of a content table in content.db.
+type ContentItem struct {
+	Type     string // table name: essays, notes, papers, ...
+	Slug     string
+	Category string
+	State    string
+	Title    string
+}
+
+// loadContent lists content from the database at dbPath. types and states
+// filter by table and state column; empty means everything.
+func loadContent(dbPath string, types, states []string) ([]ContentItem, error) {
+	if _, err := os.Stat(dbPath); err != nil {
+		return nil, err
+	}
+	db, err := sql.Open("sqlite3", "file:"+dbPath+"?mode=ro")
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	all, err := contentTypes(db)
+	if err != nil {
+		return nil, err
+	}
+	selected := all
+	if len(types) > 0 {
+		known := make(map[string]bool, len(all))
+		for _, t := range all {
+			known[t] = true
+		}
+		selected = nil
+		for _, t := range types {
+			if !known[t] {
+				return nil, fmt.Errorf("unknown content type %q (have %s)", t, strings.Join(all, ", "))
+			}
+			selected = append(selected, t)
+		}
+	}
+
+	var items []ContentItem
+	for _, t := range selected {
+		query := fmt.Sprintf(`SELECT slug, COALESCE(category_slug, ''), COALESCE(state, ''), title FROM %q`, t)
+		var args []any
+		if len(states) > 0 {
+			query += " WHERE state IN (?" + strings.Repeat(", ?", len(states)-1) + ")"
+			for _, s := range states {
+				args = append(args, s)
+			}
+		}
+		query += " ORDER BY slug"
+		rows, err := db.Query(query, args...)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", t, err)
+		}
+		for rows.Next() {
+			it := ContentItem{Type: t}
+			if err := rows.Scan(&it.Slug, &it.Category, &it.State, &it.Title); err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("%s: %w", t, err)
+			}
+			items = append(items, it)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, fmt.Errorf("%s: %w", t, err)
+		}
+	}
+	return items, nil
+}
+
+// contentTypes finds the per-type content tables: those with slug,
+// category_slug and state columns, minus the non-content ones.
+func contentTypes(db *sql.DB) ([]string, error) {
+	rows, err := db.Query(`SELECT name FROM sqlite_master WHERE type = 'table' AND name NOT LIKE 'sqlite_%' ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	var tables []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		tables = append(tables, name)
+	}
+	rows.Close()
+
+	var types []string
+	for _, t := range tables {
+		if nonContentTables[t] {
+			continue
+		}
+		cols, err := tableColumns(db, t)
+		if err != nil {
+			return nil, err
+		}
+		if cols["slug"] && cols["category_slug"] && cols["state"] && cols["title"] {
+			types = append(types, t)
+		}
+	}
+	sort.Strings(types)
+	return types, nil
+}
+
+func tableColumns(db *sql.DB, table string) (map[string]bool, error) {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%q)", table))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	cols := make(map[string]bool)
+	for rows.Next() {
+		var (
+			cid, notNull, pk int
+			name, typ        string
+			dflt             sql.NullString
+		)
+		if err := rows.Scan(&cid, &name, &typ, &notNull, &dflt, &pk); err != nil {
+			return nil, err
+		}
+		cols[name] = true
+	}
+	return cols, rows.Err()
+}
+
+// mdxPath resolves an item to its MDX (or .md) file under root, trying the
+// flat src/content/[type]/[slug].mdx layout first, then the older
+// [type]/content/[category]/[slug].mdx and [type]/[slug]/page.mdx ones.
+// It returns "" when no file exists.
+func mdxPath(root string, it ContentItem) string {
+	var candidates []string
+	for _, ext := range []string{".mdx", ".md"} {
+		candidates = append(candidates, filepath.Join(root, it.Type, it.Slug+ext))
+	}
+	if it.Category != "" {
+		candidates = append(candidates, filepath.Join(root, it.Type, "content", it.Category, it.Slug+".mdx"))
+	}
+	candidates = append(candidates,
+		filepath.Join(root, it.Type, "content", it.Slug+".mdx"),
+		filepath.Join(root, it.Type, it.Slug, "page.mdx"),
+	)
+	for _, c := range candidates {
+		if info, err := os.Stat(c); err == nil && !info.IsDir() {
+			return c
+		}
+	}
+	return ""
+}
+
+// collectPaths resolves items to the files to scan. Bibliography and
+// margin-note JSON live beside page.mdx, or for flat [slug].mdx files in a
+// sibling [slug]/ directory. Items with no MDX file are returned in missing.
+func collectPaths(root string, items []ContentItem) (paths []SourceFile, missing []ContentItem) {
+	for _, it := range items {
+		mdx := mdxPath(root, it)
+		if mdx == "" {
+			missing = append(missing, it)
+			continue
+		}
+		paths = append(paths, SourceFile{Path: mdx, Type: it.Type, Slug: it.Slug})
+		dir := filepath.Dir(mdx)
+		if filepath.Base(mdx) != "page.mdx" {
+			dir = filepath.Join(dir, it.Slug)
+		}
+		for _, fname := range []string{"bibliography.json", "margin-notes.json"} {
+			fp := filepath.Join(dir, fname)
+			if _, err := os.Stat(fp); err == nil {
+				paths = append(paths, SourceFile{Path: fp, Type: it.Type, Slug: it.Slug})
+			}
+		}
+	}
+	return paths, missing
+}
+
+// splitList splits a comma-separated flag value, dropping blanks.
+func splitList(s string) []string {
+	var out []string
+	for _, p := range strings.Split(s, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			out = append(out, p)
+		}
+	}
+	return out
+}
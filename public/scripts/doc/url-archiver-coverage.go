@@ -0,0 +1,201 @@
+// -----------------------------------------------------------------------------
+// File:          url-archiver-coverage.go
+// Description:   Archive coverage per content item for URLArchiverV1
+//                ("coverage"). For every scanned page, counts the distinct
+//                outbound URLs it cites and how many have at least one
+//                verified snapshot in the ledger, and writes the numbers to
+//                the archive_coverage table in content.db for the site's
+//                archival coverage indicator. A snapshot is verified when
+//                the Wayback availability API reports a 2xx capture, the
+//                WARC holds a 2xx response, or the archive.today or
+//                Ghostarchive snapshot URL answers a HEAD with a 2xx.
+//
+//                archive_coverage is keyed like content_tags, by content_type
+//                plus the item's slug and id; coverage is a percentage and
+//                NULL for pages that cite nothing:
+//
+//                  SELECT content_type, slug, coverage FROM archive_coverage
+//                  WHERE coverage IS NOT NULL ORDER BY coverage, urls DESC;
+// Author:        Kris Yotam
+// License:       CC-0
+// -----------------------------------------------------------------------------
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"time"
+)
+
+const coverageSchema = `
+CREATE TABLE IF NOT EXISTS archive_coverage (
+  content_type TEXT NOT NULL,
+  content_id INTEGER,
+  slug TEXT NOT NULL,
+  urls INTEGER NOT NULL,
+  archived INTEGER NOT NULL,
+  coverage REAL,
+  updated_at TEXT NOT NULL,
+  PRIMARY KEY (content_type, slug)
+);
+CREATE INDEX IF NOT EXISTS idx_archive_coverage_coverage ON archive_coverage(coverage);
+`
+
+// PageCoverage is the archive coverage of one content item.
+type PageCoverage struct {
+	Type     string
+	Slug     string
+	URLs     int // distinct outbound URLs
+	Archived int // of those, the ones with a verified snapshot
+}
+
+// Percent is the share of URLs archived, and false when there are none.
+func (c PageCoverage) Percent() (float64, bool) {
+	if c.URLs == 0 {
+		return 0, false
+	}
+	return 100 * float64(c.Archived) / float64(c.URLs), true
+}
+
+// computeCoverage tallies, for each content item with a scanned file, its
+// distinct URLs in refs and how many of them are in snapshotted. Items are
+// sorted worst-covered first, then by how much they cite.
+func computeCoverage(files []SourceFile, refs []URLRef, snapshotted map[string]bool) []PageCoverage {
+	pages := make(map[string]*PageCoverage)
+	for _, f := range files {
+		if key := f.Type + "/" + f.Slug; pages[key] == nil {
+			pages[key] = &PageCoverage{Type: f.Type, Slug: f.Slug}
+		}
+	}
+	seen := make(map[string]bool)
+	for _, r := range refs {
+		p := pages[r.Type+"/"+r.Slug]
+		key := r.Type + "/" + r.Slug + "\x00" + r.URL
+		if p == nil || seen[key] {
+			continue
+		}
+		seen[key] = true
+		p.URLs++
+		if snapshotted[r.URL] {
+			p.Archived++
+		}
+	}
+
+	out := make([]PageCoverage, 0, len(pages))
+	for _, p := range pages {
+		out = append(out, *p)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		pi, oki := out[i].Percent()
+		pj, okj := out[j].Percent()
+		switch {
+		case oki != okj:
+			return oki // pages citing nothing go last
+		case pi != pj:
+			return pi < pj
+		case out[i].URLs != out[j].URLs:
+			return out[i].URLs > out[j].URLs
+		case out[i].Type != out[j].Type:
+			return out[i].Type < out[j].Type
+		}
+		return out[i].Slug < out[j].Slug
+	})
+	return out
+}
+
+// writeCoverage upserts pages into content.db's archive_coverage table. On
+// a full scan, rows for pages that no longer exist are removed.
+func writeCoverage(dbPath string, pages []PageCoverage, full bool, at time.Time) error {
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if _, err := db.Exec(coverageSchema); err != nil {
+		return err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	stamp := at.UTC().Format(ledgerTimeLayout)
+	for _, p := range pages {
+		var coverage any
+		if pct, ok := p.Percent(); ok {
+			coverage = pct
+		}
+		// p.Type is a table name from contentTypes, so quoting it is enough.
+		_, err := tx.Exec(fmt.Sprintf(`
+			INSERT INTO archive_coverage (content_type, content_id, slug, urls, archived, coverage, updated_at)
+			VALUES (?, (SELECT id FROM %q WHERE slug = ?), ?, ?, ?, ?, ?)
+			ON CONFLICT(content_type, slug) DO UPDATE SET
+			  content_id = excluded.content_id, urls = excluded.urls, archived = excluded.archived,
+			  coverage = excluded.coverage, updated_at = excluded.updated_at`, p.Type),
+			p.Type, p.Slug, p.Slug, p.URLs, p.Archived, coverage, stamp)
+		if err != nil {
+			return fmt.Errorf("%s/%s: %w", p.Type, p.Slug, err)
+		}
+	}
+	if full {
+		if _, err := tx.Exec(`DELETE FROM archive_coverage WHERE updated_at < ?`, stamp); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// runCoverage is the "coverage" mode.
+func runCoverage(cfg config) {
+	set, err := gatherRefs(cfg)
+	if err != nil {
+		log.Fatalf("Failed to collect URLs: %v", err)
+	}
+	ledger, err := openLedger(cfg.LedgerPath)
+	if err != nil {
+		log.Fatalf("Failed to open ledger: %v", err)
+	}
+	snapshotted, err := ledger.Snapshotted()
+	ledger.Close()
+	if err != nil {
+		log.Fatalf("Failed to read ledger: %v", err)
+	}
+	pages := computeCoverage(set.Files, set.Refs, snapshotted)
+
+	// Only a scan of every page may prune rows; a -type, -state or -since
+	// run leaves the pages it did not look at alone.
+	full := cfg.Types == "" && cfg.States == "" && cfg.Since == ""
+	if err := writeCoverage(cfg.ContentDB, pages, full, time.Now()); err != nil {
+		log.Fatalf("Coverage write error: %v", err)
+	}
+
+	f, err := os.Create(cfg.ReportPath)
+	if err != nil {
+		log.Fatalf("Report create error: %v", err)
+	}
+	defer f.Close()
+	urls, archived, citing := 0, 0, 0
+	for _, p := range pages {
+		pct, ok := p.Percent()
+		if !ok {
+			continue
+		}
+		citing++
+		urls += p.URLs
+		archived += p.Archived
+		f.WriteString(fmt.Sprintf("%5.1f%% %d/%d %s/%s\n", pct, p.Archived, p.URLs, p.Type, p.Slug))
+	}
+	overall := 0.0
+	if urls > 0 {
+		overall = 100 * float64(archived) / float64(urls)
+	}
+	f.WriteString(fmt.Sprintf("\n# pages citing URLs: %d\n# pages citing nothing: %d\n# overall: %d/%d (%.1f%%)\n",
+		citing, len(pages)-citing, archived, urls, overall))
+
+	fmt.Printf("Coverage complete: %d pages, %.1f%% of %d outbound links archived. Written to %s (archive_coverage). Report: %s\n",
+		len(pages), overall, urls, cfg.ContentDB, cfg.ReportPath)
+}
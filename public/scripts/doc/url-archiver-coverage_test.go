@@ -0,0 +1,44 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSnapshottedCountsVerifiedOnly(t *testing.T) {
+	ledger, err := openLedger(filepath.Join(t.TempDir(), "ledger.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ledger.Close()
+	now := time.Now()
+	results := []ArchiveResult{
+		{URL: "https://a.example/", Service: "archive.org", Archived: true, Verified: true, SnapshotURL: "https://web.archive.org/web/1/https://a.example/"},
+		{URL: "https://b.example/", Service: "archive.today", Archived: true, SnapshotURL: "https://archive.ph/b"},
+		{URL: "https://c.example/", Service: "warc", Error: &httpStatusError{Prefix: "warc", Status: 404}, HTTPStatus: 404},
+		// A later verified capture of the same snapshot upgrades it.
+		{URL: "https://d.example/", Service: "archive.org", Archived: true, SnapshotURL: "https://web.archive.org/web/2/https://d.example/"},
+		{URL: "https://d.example/", Service: "archive.org", Archived: true, Verified: true, SnapshotURL: "https://web.archive.org/web/2/https://d.example/"},
+	}
+	for _, r := range results {
+		if err := ledger.Record(r, now); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, err := ledger.Snapshotted()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || !got["https://a.example/"] || !got["https://d.example/"] {
+		t.Errorf("snapshotted = %v, want only a.example and d.example", got)
+	}
+
+	pages := computeCoverage(
+		[]SourceFile{{Type: "essays", Slug: "one"}},
+		[]URLRef{{Type: "essays", Slug: "one", URL: "https://a.example/"}, {Type: "essays", Slug: "one", URL: "https://b.example/"}},
+		got)
+	if len(pages) != 1 || pages[0].URLs != 2 || pages[0].Archived != 1 {
+		t.Errorf("coverage = %+v, want 1 of 2 archived", pages)
+	}
+}
@@ -0,0 +1,417 @@
+// -----------------------------------------------------------------------------
+// File:          url-archiver-daemon.go
+// Description:   Long-running service mode for URLArchiverV1 ("serve"). Jobs
+//                live in the ledger's archive_queue table so they survive
+//                restarts, and are worked through with the same archivers,
+//                rate limits, retries and circuit breakers as a batch run.
+//                Editor tooling enqueues a URL the moment it is pasted.
+// Author:        Kris Yotam
+// License:       CC-0
+//
+// HTTP API (JSON, -listen, default 127.0.0.1:8089):
+//   POST /submit       {"url": "...", "services": ["archive.org"], "force": false}
+//                      -> 202 with the queued jobs, or 200 when every service
+//                         already has a snapshot younger than -maxAge
+//   GET  /status?url=  queue jobs and ledger snapshots for one URL
+//   GET  /jobs/{id}    one queue job
+//   GET  /pending      queued and running jobs, oldest first
+//   GET  /health       queue counts and circuit breaker state
+// -----------------------------------------------------------------------------
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// queuePoll is how often idle workers look for jobs another process
+	// may have added to the ledger.
+	queuePoll = 30 * time.Second
+	// maxSubmitBody caps the size of a /submit request.
+	maxSubmitBody = 64 << 10
+)
+
+// daemon holds the state shared by the HTTP handlers and the workers.
+type daemon struct {
+	cfg       config
+	ledger    *Ledger
+	mu        sync.Mutex // serialises ledger access
+	archivers map[string]Archiver
+	services  []string // -services, the default for /submit
+	breakers  map[string]*circuitBreaker
+	rules     normalizeRules
+	policy    *urlPolicy
+	wake      chan struct{}
+	started   time.Time
+}
+
+// submitRequest is the body of POST /submit.
+type submitRequest struct {
+	URL      string   `json:"url"`
+	Services []string `json:"services,omitempty"`
+	Force    bool     `json:"force,omitempty"` // queue even if a fresh snapshot exists
+}
+
+// serviceSnapshot is what the ledger knows about a URL on one service.
+type serviceSnapshot struct {
+	Service        string `json:"service"`
+	SnapshotURL    string `json:"snapshot_url,omitempty"`
+	SnapshotAt     string `json:"snapshot_at,omitempty"`
+	LastArchivedAt string `json:"last_archived_at,omitempty"`
+	LastError      string `json:"last_error,omitempty"`
+}
+
+func snapshotOf(e *LedgerEntry) serviceSnapshot {
+	s := serviceSnapshot{Service: e.Service, SnapshotURL: e.SnapshotURL, LastError: e.LastError}
+	if !e.SnapshotAt.IsZero() {
+		s.SnapshotAt = e.SnapshotAt.Format(time.RFC3339)
+	}
+	if !e.LastArchivedAt.IsZero() {
+		s.LastArchivedAt = e.LastArchivedAt.Format(time.RFC3339)
+	}
+	return s
+}
+
+// runServe is the "serve" mode.
+func runServe(ctx context.Context, cfg config) {
+	ledger, err := openLedger(cfg.LedgerPath)
+	if err != nil {
+		log.Fatalf("Failed to open ledger: %v", err)
+	}
+	defer ledger.Close()
+	rules, err := loadNormalizeRules(cfg.NormalizeRules)
+	if err != nil {
+		log.Fatalf("Failed to load normalize rules: %v", err)
+	}
+	policy, err := loadPolicy(cfg.PolicyPath)
+	if err != nil {
+		log.Fatalf("Failed to load policy: %v", err)
+	}
+	policy.denyOwnSite(siteHost(cfg.SiteURL))
+	archivers, breakers, err := newArchivers(cfg, newFetchGuard(cfg))
+	if err != nil {
+		log.Fatalf("Invalid -services: %v", err)
+	}
+	defer closeArchivers(archivers)
+
+	d := &daemon{
+		cfg:       cfg,
+		ledger:    ledger,
+		archivers: make(map[string]Archiver, len(archivers)),
+		breakers:  breakers,
+		rules:     rules,
+		policy:    policy,
+		wake:      make(chan struct{}, cfg.Concurrency),
+		started:   time.Now(),
+	}
+	for _, a := range archivers {
+		d.archivers[a.Name()] = a
+		d.services = append(d.services, a.Name())
+	}
+	n, err := ledger.RequeueRunning(0)
+	if err != nil {
+		log.Fatalf("Failed to read queue: %v", err)
+	}
+	if n > 0 {
+		fmt.Printf("Requeued %d jobs left running by the last shutdown\n", n)
+	}
+
+	var workers sync.WaitGroup
+	for i := 0; i < cfg.Concurrency; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			d.work(ctx)
+		}()
+	}
+
+	srv := &http.Server{Addr: cfg.Listen, Handler: d.routes(), ReadHeaderTimeout: 10 * time.Second}
+	errc := make(chan error, 1)
+	go func() { errc <- srv.ListenAndServe() }()
+	fmt.Printf("Serving on http://%s with %s, %d workers\n", cfg.Listen, strings.Join(d.services, ", "), cfg.Concurrency)
+
+	select {
+	case err := <-errc:
+		log.Fatalf("Listen error: %v", err)
+	case <-ctx.Done():
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	srv.Shutdown(shutdownCtx)
+	workers.Wait()
+	fmt.Println("Stopped; unfinished jobs stay queued for the next start.")
+}
+
+// work claims and archives jobs until ctx is cancelled, leaving jobs for
+// services with an open circuit breaker in the queue.
+func (d *daemon) work(ctx context.Context) {
+	for ctx.Err() == nil {
+		now := time.Now()
+		paused, resume := d.paused(now)
+		d.mu.Lock()
+		job, err := d.ledger.ClaimJob(now, paused...)
+		d.mu.Unlock()
+		if err != nil {
+			log.Printf("Queue read error: %v", err)
+		}
+		if job == nil {
+			wait := queuePoll
+			if !resume.IsZero() && resume.Sub(now) < wait {
+				wait = resume.Sub(now)
+			}
+			select {
+			case <-ctx.Done():
+			case <-d.wake:
+			case <-time.After(wait):
+			}
+			continue
+		}
+
+		var res ArchiveResult
+		if a := d.archivers[job.Service]; a != nil {
+			res = a.Archive(ctx, job.URL)
+		} else {
+			res = ArchiveResult{URL: job.URL, Service: job.Service, Error: fmt.Errorf("service %s is not enabled in this daemon", job.Service)}
+		}
+
+		// A job cut short by shutdown, or never tried because its service's
+		// breaker opened, is not a failure of the URL and goes back in the
+		// queue; paused keeps it from being claimed again until the breaker
+		// lets calls through.
+		skipped := errors.Is(res.Error, errCircuitOpen)
+		d.mu.Lock()
+		now = time.Now()
+		if skipped || (ctx.Err() != nil && !res.Archived) {
+			if _, err := d.ledger.RequeueRunning(job.ID); err != nil {
+				log.Printf("Queue write error %s: %v", job.URL, err)
+			}
+		} else {
+			if err := d.ledger.Record(res, now); err != nil {
+				log.Printf("Ledger write error %s: %v", job.URL, err)
+			}
+			if err := d.ledger.FinishJob(job.ID, res, now); err != nil {
+				log.Printf("Queue write error %s: %v", job.URL, err)
+			}
+		}
+		d.mu.Unlock()
+		switch {
+		case res.Archived:
+			log.Printf("%s: archived %s -> %s", job.Service, job.URL, res.SnapshotURL)
+		case skipped:
+			log.Printf("%s: paused, %s stays queued", job.Service, job.URL)
+		case ctx.Err() == nil:
+			log.Printf("%s: failed %s: %v", job.Service, job.URL, res.Error)
+		}
+	}
+}
+
+// paused lists the services whose circuit breaker is open at now, and when
+// the first of them may take calls again.
+func (d *daemon) paused(now time.Time) (services []string, resume time.Time) {
+	for name, b := range d.breakers {
+		if !b.Open(now) {
+			continue
+		}
+		services = append(services, name)
+		until := b.PausedUntil()
+		if floor := now.Add(time.Second); until.Before(floor) {
+			until = floor // a half-open trial is still running
+		}
+		if resume.IsZero() || until.Before(resume) {
+			resume = until
+		}
+	}
+	return services, resume
+}
+
+// routes builds the HTTP API.
+func (d *daemon) routes() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /submit", d.handleSubmit)
+	mux.HandleFunc("GET /status", d.handleStatus)
+	mux.HandleFunc("GET /jobs/{id}", d.handleJob)
+	mux.HandleFunc("GET /pending", d.handlePending)
+	mux.HandleFunc("GET /health", d.handleHealth)
+	return mux
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
+
+func (d *daemon) handleSubmit(w http.ResponseWriter, r *http.Request) {
+	var req submitRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxSubmitBody)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid JSON body: "+err.Error())
+		return
+	}
+	raw := strings.TrimSpace(req.URL)
+	if !isHTTPURL(raw) {
+		writeError(w, http.StatusBadRequest, "url must be an absolute http(s) URL")
+		return
+	}
+	u := d.rules.normalizeURL(raw)
+	if action, reason := d.policy.Decide(u); action == policyDeny {
+		writeJSON(w, http.StatusForbidden, map[string]string{"error": "excluded by policy", "url": u, "reason": reason})
+		return
+	}
+	services := req.Services
+	if len(services) == 0 {
+		services = d.services
+	}
+	for _, s := range services {
+		if d.archivers[s] == nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("service %q is not enabled (have %s)", s, strings.Join(d.services, ", ")))
+			return
+		}
+	}
+
+	resp := struct {
+		URL   string            `json:"url"`
+		Jobs  []QueueJob        `json:"jobs"`
+		Fresh []serviceSnapshot `json:"fresh,omitempty"` // services skipped: snapshot younger than -maxAge
+	}{URL: u, Jobs: []QueueJob{}}
+	d.mu.Lock()
+	now := time.Now()
+	for _, s := range services {
+		if !req.Force {
+			due, err := d.ledger.Due([]string{u}, s, d.cfg.MaxAge, now)
+			if err == nil && len(due) == 0 {
+				if e, err := d.ledger.Lookup(u, s); err == nil && e != nil {
+					resp.Fresh = append(resp.Fresh, snapshotOf(e))
+					continue
+				}
+			}
+		}
+		job, err := d.ledger.Enqueue(u, s, now)
+		if err != nil {
+			d.mu.Unlock()
+			writeError(w, http.StatusInternalServerError, "queue write: "+err.Error())
+			return
+		}
+		resp.Jobs = append(resp.Jobs, job)
+	}
+	d.mu.Unlock()
+
+	status := http.StatusOK
+	for range resp.Jobs {
+		status = http.StatusAccepted
+		select {
+		case d.wake <- struct{}{}:
+		default:
+		}
+	}
+	writeJSON(w, status, resp)
+}
+
+func (d *daemon) handleStatus(w http.ResponseWriter, r *http.Request) {
+	raw := strings.TrimSpace(r.URL.Query().Get("url"))
+	if raw == "" {
+		writeError(w, http.StatusBadRequest, "missing url parameter")
+		return
+	}
+	u := d.rules.normalizeURL(raw)
+	resp := struct {
+		URL       string            `json:"url"`
+		Jobs      []QueueJob        `json:"jobs"`
+		Snapshots []serviceSnapshot `json:"snapshots"`
+	}{URL: u, Snapshots: []serviceSnapshot{}}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	jobs, err := d.ledger.QueueJobs(u)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	resp.Jobs = append([]QueueJob{}, jobs...)
+	for _, s := range registeredServices() {
+		e, err := d.ledger.Lookup(u, s)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if e != nil {
+			resp.Snapshots = append(resp.Snapshots, snapshotOf(e))
+		}
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (d *daemon) handleJob(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "job id must be a number")
+		return
+	}
+	d.mu.Lock()
+	job, err := d.ledger.QueueJobByID(id)
+	d.mu.Unlock()
+	switch {
+	case err != nil:
+		writeError(w, http.StatusInternalServerError, err.Error())
+	case job == nil:
+		writeError(w, http.StatusNotFound, "no such job")
+	default:
+		writeJSON(w, http.StatusOK, job)
+	}
+}
+
+func (d *daemon) handlePending(w http.ResponseWriter, r *http.Request) {
+	d.mu.Lock()
+	jobs, err := d.ledger.QueueJobs("")
+	d.mu.Unlock()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string][]QueueJob{"jobs": append([]QueueJob{}, jobs...)})
+}
+
+func (d *daemon) handleHealth(w http.ResponseWriter, r *http.Request) {
+	type serviceHealth struct {
+		Name        string `json:"name"`
+		PausedUntil string `json:"paused_until,omitempty"` // circuit breaker open
+		Trips       int    `json:"trips"`
+	}
+	d.mu.Lock()
+	counts, err := d.ledger.QueueCounts()
+	d.mu.Unlock()
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, "ledger: "+err.Error())
+		return
+	}
+	resp := struct {
+		Status   string          `json:"status"`
+		Uptime   string          `json:"uptime"`
+		Queue    map[string]int  `json:"queue"`
+		Services []serviceHealth `json:"services"`
+	}{Status: "ok", Uptime: time.Since(d.started).Round(time.Second).String(), Queue: counts}
+	now := time.Now()
+	for _, name := range d.services {
+		h := serviceHealth{Name: name, Trips: d.breakers[name].Trips()}
+		if until := d.breakers[name].PausedUntil(); until.After(now) {
+			h.PausedUntil = until.UTC().Format(time.RFC3339)
+			resp.Status = "degraded"
+		}
+		resp.Services = append(resp.Services, h)
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDaemonSkipsPausedServices(t *testing.T) {
+	ledger, err := openLedger(filepath.Join(t.TempDir(), "ledger.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ledger.Close()
+	now := time.Now()
+	if _, err := ledger.Enqueue("https://example.com/essay", "archive.org", now); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ledger.Enqueue("https://example.com/essay", "warc", now); err != nil {
+		t.Fatal(err)
+	}
+
+	open := newCircuitBreaker(1, time.Minute)
+	open.Report(false, now)
+	d := &daemon{ledger: ledger, breakers: map[string]*circuitBreaker{
+		"archive.org": open,
+		"warc":        newCircuitBreaker(1, time.Minute),
+	}}
+	paused, resume := d.paused(now)
+	if len(paused) != 1 || paused[0] != "archive.org" {
+		t.Fatalf("paused = %v, want [archive.org]", paused)
+	}
+	if want := now.Add(time.Minute); !resume.Equal(want) {
+		t.Errorf("resume = %v, want %v", resume, want)
+	}
+
+	job, err := ledger.ClaimJob(now, paused...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job == nil || job.Service != "warc" {
+		t.Fatalf("claimed %+v, want the warc job", job)
+	}
+	if job, err := ledger.ClaimJob(now, paused...); err != nil || job != nil {
+		t.Errorf("claimed %+v (%v), want nothing while archive.org is paused", job, err)
+	}
+}
@@ -0,0 +1,295 @@
+// -----------------------------------------------------------------------------
+// File:          url-archiver-drift.go
+// Description:   Content drift detection for URLArchiverV1. When a cited page
+//                is archived we store a hash and MinHash sketch of its
+//                normalised text; later check runs refetch it and flag pages
+//                whose text has changed materially, with a similarity score,
+//                so silent edits to a source after we cited it get noticed.
+// Author:        Kris Yotam
+// License:       CC-0
+// -----------------------------------------------------------------------------
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash/fnv"
+	"html"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// Values accepted by -drift.
+const (
+	driftCitations = "citations" // bibliography entries and margin notes only
+	driftAll       = "all"
+	driftOff       = "off"
+)
+
+const (
+	// maxPageBody caps how much of a page is read for its fingerprint or
+	// text snapshot.
+	maxPageBody = 4 << 20
+	// sketchSize is the number of MinHash values kept per page.
+	sketchSize = 64
+	// shingleWords is the length in words of the shingles compared.
+	shingleWords = 5
+)
+
+var (
+	dropElementRegex = regexp.MustCompile(`(?is)<(script|style|noscript|template|svg)\b.*?</(script|style|noscript|template|svg)\s*>|<!--.*?-->`)
+	tagRegex         = regexp.MustCompile(`(?s)<[^>]*>`)
+)
+
+// Fingerprint summarises a page's normalised text: an exact hash plus a
+// MinHash sketch over word shingles for estimating how much changed.
+type Fingerprint struct {
+	Hash   string
+	Sketch []uint64
+}
+
+// DriftResult is the comparison of a page against its baseline fingerprint.
+type DriftResult struct {
+	URL        string
+	Similarity float64 // 1 means unchanged
+	BaselineAt time.Time
+	Error      error
+}
+
+// Drifted reports whether the page changed more than threshold allows.
+func (d DriftResult) Drifted(threshold float64) bool {
+	return d.Error == nil && d.Similarity < threshold
+}
+
+// normalizeText reduces a response body to comparable text: markup, scripts
+// and comments removed, entities decoded, whitespace collapsed, lowercased.
+func normalizeText(body []byte, contentType string) string {
+	text := string(body)
+	if contentType == "" || strings.Contains(contentType, "html") || strings.Contains(contentType, "xml") {
+		text = dropElementRegex.ReplaceAllString(text, " ")
+		text = tagRegex.ReplaceAllString(text, " ")
+		text = html.UnescapeString(text)
+	}
+	return strings.Join(strings.Fields(strings.ToLower(text)), " ")
+}
+
+// fingerprintText hashes text and builds its MinHash sketch.
+func fingerprintText(text string) Fingerprint {
+	sum := sha256.Sum256([]byte(text))
+	fp := Fingerprint{Hash: hex.EncodeToString(sum[:]), Sketch: make([]uint64, sketchSize)}
+	for i := range fp.Sketch {
+		fp.Sketch[i] = ^uint64(0)
+	}
+	words := strings.Fields(text)
+	n := len(words) - shingleWords + 1
+	if n < 1 && len(words) > 0 {
+		n = 1
+	}
+	for i := 0; i < n; i++ {
+		end := min(i+shingleWords, len(words))
+		h := fnv.New64a()
+		io.WriteString(h, strings.Join(words[i:end], " "))
+		base := h.Sum64()
+		for k := range fp.Sketch {
+			if v := splitmix64(base ^ uint64(k)*0x9e3779b97f4a7c15); v < fp.Sketch[k] {
+				fp.Sketch[k] = v
+			}
+		}
+	}
+	return fp
+}
+
+// splitmix64 is the finaliser of the SplitMix64 generator, used to derive
+// the independent hash functions MinHash needs from one FNV hash.
+func splitmix64(x uint64) uint64 {
+	x += 0x9e3779b97f4a7c15
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	return x ^ (x >> 31)
+}
+
+// similarity estimates the Jaccard similarity of two pages' shingle sets.
+func similarity(a, b Fingerprint) float64 {
+	if a.Hash == b.Hash {
+		return 1
+	}
+	if len(a.Sketch) != len(b.Sketch) || len(a.Sketch) == 0 {
+		return 0
+	}
+	same := 0
+	for i := range a.Sketch {
+		if a.Sketch[i] == b.Sketch[i] {
+			same++
+		}
+	}
+	return float64(same) / float64(len(a.Sketch))
+}
+
+// encodeSketch and decodeSketch store a sketch as hex in the ledger.
+func encodeSketch(s []uint64) string {
+	buf := make([]byte, 8*len(s))
+	for i, v := range s {
+		binary.BigEndian.PutUint64(buf[8*i:], v)
+	}
+	return hex.EncodeToString(buf)
+}
+
+func decodeSketch(s string) ([]uint64, error) {
+	buf, err := hex.DecodeString(s)
+	if err != nil || len(buf)%8 != 0 {
+		return nil, fmt.Errorf("bad sketch")
+	}
+	out := make([]uint64, len(buf)/8)
+	for i := range out {
+		out[i] = binary.BigEndian.Uint64(buf[8*i:])
+	}
+	return out, nil
+}
+
+// fetchedPage is a downloaded cited page.
+type fetchedPage struct {
+	Body        []byte
+	ContentType string
+}
+
+// Fingerprint fingerprints the page's normalised text.
+func (p fetchedPage) Fingerprint() Fingerprint {
+	return fingerprintText(normalizeText(p.Body, p.ContentType))
+}
+
+// fetchPage downloads up to maxPageBody bytes of target.
+func fetchPage(ctx context.Context, client *http.Client, target string) (fetchedPage, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return fetchedPage{}, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fetchedPage{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return fetchedPage{}, statusError("fetch", resp)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxPageBody))
+	if err != nil {
+		return fetchedPage{}, err
+	}
+	return fetchedPage{Body: body, ContentType: resp.Header.Get("Content-Type")}, nil
+}
+
+// driftTracked picks the URLs whose content is fingerprinted under mode.
+func driftTracked(refs []URLRef, mode string) map[string]bool {
+	tracked := make(map[string]bool)
+	for _, r := range refs {
+		if mode == driftAll || (mode == driftCitations && r.Citation != nil) {
+			tracked[r.URL] = true
+		}
+	}
+	return tracked
+}
+
+// fetchPages downloads urls concurrently under the host rate limit and
+// robots.txt, calling fn (serialised) with each outcome. URLs robots.txt
+// rules out get errRobotsDisallowed.
+func fetchPages(ctx context.Context, cfg config, guard *fetchGuard, urls []string, fn func(string, fetchedPage, error)) {
+	eg, egCtx := errgroup.WithContext(ctx)
+	eg.SetLimit(cfg.Concurrency)
+	var mu sync.Mutex
+	for _, u := range urls {
+		u := u
+		if egCtx.Err() != nil {
+			break
+		}
+		eg.Go(func() error {
+			if !guard.robots.Allowed(egCtx, u) {
+				mu.Lock()
+				fn(u, fetchedPage{}, errRobotsDisallowed)
+				mu.Unlock()
+				return nil
+			}
+			if err := guard.hosts.Wait(egCtx, u); err != nil {
+				return nil
+			}
+			page, err := fetchPage(egCtx, guard.client, u)
+			if egCtx.Err() != nil {
+				return nil
+			}
+			mu.Lock()
+			fn(u, page, err)
+			mu.Unlock()
+			return nil
+		})
+	}
+	eg.Wait()
+}
+
+// needBaseline picks the tracked URLs archived in this run that have no
+// baseline yet. The first baseline is kept so drift is always measured
+// against the page as it was when we first archived it.
+func needBaseline(ledger *Ledger, results []ArchiveResult, tracked map[string]bool) map[string]bool {
+	need := make(map[string]bool)
+	for _, r := range results {
+		if !r.Archived || !tracked[r.URL] || need[r.URL] {
+			continue
+		}
+		b, err := ledger.Baseline(r.URL)
+		if err != nil {
+			log.Printf("Ledger read error %s: %v", r.URL, err)
+			continue
+		}
+		if b == nil {
+			need[r.URL] = true
+		}
+	}
+	return need
+}
+
+// checkDrift refetches tracked URLs that have a baseline and are still
+// reachable, and scores them against it.
+func checkDrift(ctx context.Context, cfg config, guard *fetchGuard, ledger *Ledger, results []CheckResult, tracked map[string]bool) []DriftResult {
+	baselines := make(map[string]*PageBaseline)
+	var urls []string
+	for _, r := range results {
+		if r.Broken() || r.Status == linkRobots || !tracked[r.URL] {
+			continue
+		}
+		b, err := ledger.Baseline(r.URL)
+		if err != nil {
+			log.Printf("Ledger read error %s: %v", r.URL, err)
+			continue
+		}
+		if b != nil {
+			baselines[r.URL] = b
+			urls = append(urls, r.URL)
+		}
+	}
+	var drift []DriftResult
+	now := time.Now()
+	fetchPages(ctx, cfg, guard, urls, func(u string, page fetchedPage, err error) {
+		b := baselines[u]
+		d := DriftResult{URL: u, BaselineAt: b.CapturedAt, Error: err}
+		if err == nil {
+			fp := page.Fingerprint()
+			d.Similarity = similarity(b.Fingerprint, fp)
+			if err := ledger.RecordDrift(u, fp, d.Similarity, now); err != nil {
+				log.Printf("Ledger write error %s: %v", u, err)
+			}
+		}
+		drift = append(drift, d)
+	})
+	sort.Slice(drift, func(i, j int) bool { return drift[i].URL < drift[j].URL })
+	return drift
+}
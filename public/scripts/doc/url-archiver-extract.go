@@ -0,0 +1,360 @@
+// -----------------------------------------------------------------------------
+// File:          url-archiver-extract.go
+// Description:   Markdown/MDX-aware URL extraction for URLArchiverV1. Understands
+//                inline links, reference definitions, autolinks, JSX href/src
+//                attributes and frontmatter, and skips fenced and inline code.
+// Author:        Kris Yotam
+// License:       CC-0
+// -----------------------------------------------------------------------------
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"log"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Kinds of link recorded in URLRef.Kind.
+const (
+	refInline      = "inline"
+	refReference   = "reference"
+	refAutolink    = "autolink"
+	refJSX         = "jsx"
+	refFrontmatter = "frontmatter"
+	refBare        = "bare"
+)
+
+// URLRef records one occurrence of a URL in a source file.
+type URLRef struct {
+	URL      string
+	Original string // URL as written in the source, before normalisation
+	File     string
+	Line     int
+	Kind     string
+	Type     string    // content type (content.db table) the file belongs to
+	Slug     string    // content slug the file belongs to
+	Citation *Citation // set for bibliography entries and margin notes
+}
+
+var (
+	fenceRegex    = regexp.MustCompile("^ {0,3}(`{3,}|~{3,})")
+	refDefRegex   = regexp.MustCompile(`^ {0,3}\[[^\]]+\]:\s*<?([^\s>]+)>?`)
+	autolinkRegex = regexp.MustCompile(`<(https?://[^\s<>]+)>`)
+	jsxAttrRegex  = regexp.MustCompile(`\b(?:href|src)\s*=\s*(?:"([^"]*)"|'([^']*)'|\{\s*["'` + "`" + `]([^"'` + "`" + `]*)["'` + "`" + `]\s*\})`)
+	bareURLRegex  = regexp.MustCompile(`https?://[^\s<>"'` + "`" + `]+`)
+)
+
+// extractURLs returns the distinct URLs referenced by files, sorted.
+func extractURLs(files []SourceFile) []string {
+	return uniqueURLs(extractRefs(files))
+}
+
+// extractRefs returns every URL occurrence in files with its position.
+func extractRefs(files []SourceFile) []URLRef {
+	var refs []URLRef
+	for _, r := range extractLinks(files) {
+		if isHTTPURL(r.URL) {
+			refs = append(refs, r)
+		}
+	}
+	return refs
+}
+
+// extractLinks is extractRefs plus the site-relative links (/essays/...)
+// written as inline, reference or JSX links.
+func extractLinks(files []SourceFile) []URLRef {
+	var refs []URLRef
+	for _, f := range files {
+		data, err := os.ReadFile(f.Path)
+		if err != nil {
+			log.Printf("Read error %s: %v", f.Path, err)
+			continue
+		}
+		var found []URLRef
+		if strings.HasSuffix(f.Path, ".json") {
+			found = scanJSON(f.Path, data)
+		} else {
+			found = scanMarkdown(f.Path, data)
+		}
+		for i := range found {
+			found[i].Type = f.Type
+			found[i].Slug = f.Slug
+		}
+		refs = append(refs, found...)
+	}
+	return refs
+}
+
+// uniqueURLs collapses refs into a sorted list of distinct URLs.
+func uniqueURLs(refs []URLRef) []string {
+	seen := make(map[string]struct{}, len(refs))
+	urls := make([]string, 0, len(refs))
+	for _, r := range refs {
+		if _, ok := seen[r.URL]; ok {
+			continue
+		}
+		seen[r.URL] = struct{}{}
+		urls = append(urls, r.URL)
+	}
+	sort.Strings(urls)
+	return urls
+}
+
+// canonicalizeRefs rewrites each ref's URL to its canonical form, keeping
+// the spelling found in the source in Original. An http:// URL whose https://
+// form is also cited is folded into it; one cited only over http is left
+// alone, since plenty of old sites never got a certificate.
+func canonicalizeRefs(refs []URLRef, rules normalizeRules) {
+	canon := make(map[string]bool, len(refs))
+	for i := range refs {
+		refs[i].Original = refs[i].URL
+		refs[i].URL = rules.normalizeURL(refs[i].URL)
+		canon[refs[i].URL] = true
+	}
+	for i := range refs {
+		if rest, ok := strings.CutPrefix(refs[i].URL, "http://"); ok && canon["https://"+rest] {
+			refs[i].URL = "https://" + rest
+		}
+	}
+}
+
+// refsByURL groups refs by URL for report attribution.
+func refsByURL(refs []URLRef) map[string][]URLRef {
+	m := make(map[string][]URLRef)
+	for _, r := range refs {
+		m[r.URL] = append(m[r.URL], r)
+	}
+	return m
+}
+
+// scanMarkdown walks an MDX/Markdown file line by line.
+func scanMarkdown(file string, data []byte) []URLRef {
+	var refs []URLRef
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	sc.Buffer(make([]byte, 0, 64*1024), 4*1024*1024)
+
+	lineNo := 0
+	inFrontmatter := false
+	fence := ""
+	for sc.Scan() {
+		lineNo++
+		line := sc.Text()
+
+		// YAML frontmatter: only valid as the very first line.
+		if lineNo == 1 && strings.TrimSpace(line) == "---" {
+			inFrontmatter = true
+			continue
+		}
+		if inFrontmatter {
+			if t := strings.TrimSpace(line); t == "---" || t == "..." {
+				inFrontmatter = false
+				continue
+			}
+			for _, r := range scanBareURLs(file, []byte(line), refFrontmatter) {
+				r.Line = lineNo
+				refs = append(refs, r)
+			}
+			continue
+		}
+
+		// Fenced code: a closing fence uses the same character and is at
+		// least as long as the opening one.
+		if m := fenceRegex.FindStringSubmatch(line); m != nil {
+			switch {
+			case fence == "":
+				fence = m[1]
+			case m[1][0] == fence[0] && len(m[1]) >= len(fence) && strings.TrimSpace(line[len(m[0]):]) == "":
+				fence = ""
+			}
+			continue
+		}
+		if fence != "" {
+			continue
+		}
+
+		for _, r := range scanMarkdownLine(stripCodeSpans(line)) {
+			r.File = file
+			r.Line = lineNo
+			refs = append(refs, r)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		log.Printf("Scan error %s: %v", file, err)
+	}
+	return refs
+}
+
+// scanMarkdownLine finds links in one line of prose. Spans claimed by a
+// structured link are blanked before the bare-URL pass so nothing is
+// counted twice.
+func scanMarkdownLine(line string) []URLRef {
+	var refs []URLRef
+	buf := []byte(line)
+	claim := func(start, end int) {
+		for i := start; i < end; i++ {
+			buf[i] = ' '
+		}
+	}
+	add := func(u, kind string) {
+		if isHTTPURL(u) || (kind != refBare && isSitePath(u)) {
+			refs = append(refs, URLRef{URL: u, Kind: kind})
+		}
+	}
+
+	if m := refDefRegex.FindStringSubmatchIndex(line); m != nil {
+		add(line[m[2]:m[3]], refReference)
+		claim(m[0], m[1])
+	}
+	// Each pass reads buf, so a span already claimed (the <...> of a
+	// reference definition, say) is not matched again.
+	for _, m := range autolinkRegex.FindAllSubmatchIndex(buf, -1) {
+		add(line[m[2]:m[3]], refAutolink)
+		claim(m[0], m[1])
+	}
+	for _, m := range jsxAttrRegex.FindAllSubmatchIndex(buf, -1) {
+		for g := 2; g < len(m); g += 2 {
+			if m[g] >= 0 {
+				add(line[m[g]:m[g+1]], refJSX)
+			}
+		}
+		claim(m[0], m[1])
+	}
+	rest := string(buf)
+	for i := 0; i+1 < len(rest); i++ {
+		if rest[i] != ']' || rest[i+1] != '(' {
+			continue
+		}
+		dest, end := linkDestination(rest, i+2)
+		if end > 0 {
+			add(dest, refInline)
+			claim(i, end)
+			i = end - 1
+		}
+	}
+	for _, loc := range bareURLRegex.FindAllIndex(buf, -1) {
+		add(trimBareURL(string(buf[loc[0]:loc[1]])), refBare)
+	}
+	return refs
+}
+
+// linkDestination parses the destination of an inline link starting at i
+// (just after "]("). It allows balanced parentheses inside the URL, as in
+// Wikipedia links, and returns the index just past the closing ")".
+func linkDestination(s string, i int) (string, int) {
+	for i < len(s) && s[i] == ' ' {
+		i++
+	}
+	if i < len(s) && s[i] == '<' {
+		end := strings.IndexByte(s[i:], '>')
+		if end < 0 {
+			return "", -1
+		}
+		dest := s[i+1 : i+end]
+		close := strings.IndexByte(s[i+end:], ')')
+		if close < 0 {
+			return "", -1
+		}
+		return dest, i + end + close + 1
+	}
+	start, depth := i, 0
+	for ; i < len(s); i++ {
+		c := s[i]
+		if c == ' ' || c == '\t' {
+			break
+		}
+		if c == '(' {
+			depth++
+		}
+		if c == ')' {
+			if depth == 0 {
+				break
+			}
+			depth--
+		}
+	}
+	dest := s[start:i]
+	// Skip an optional title and find the closing parenthesis.
+	close := strings.IndexByte(s[i:], ')')
+	if close < 0 {
+		return "", -1
+	}
+	return dest, i + close + 1
+}
+
+// stripCodeSpans blanks out `inline code` so URLs inside it are ignored,
+// keeping the line length unchanged.
+func stripCodeSpans(line string) string {
+	if !strings.Contains(line, "`") {
+		return line
+	}
+	buf := []byte(line)
+	for i := 0; i < len(buf); {
+		if buf[i] != '`' {
+			i++
+			continue
+		}
+		n := 0
+		for i+n < len(buf) && buf[i+n] == '`' {
+			n++
+		}
+		delim := strings.Repeat("`", n)
+		end := strings.Index(string(buf[i+n:]), delim)
+		if end < 0 {
+			break
+		}
+		for j := i; j < i+n+end+n; j++ {
+			buf[j] = ' '
+		}
+		i += n + end + n
+	}
+	return string(buf)
+}
+
+// scanBareURLs finds plain URLs in text, attributing each to its line.
+func scanBareURLs(file string, data []byte, kind string) []URLRef {
+	var refs []URLRef
+	for n, line := range strings.Split(string(data), "\n") {
+		for _, u := range bareURLRegex.FindAllString(line, -1) {
+			if u = trimBareURL(u); isHTTPURL(u) {
+				refs = append(refs, URLRef{URL: u, File: file, Line: n + 1, Kind: kind})
+			}
+		}
+	}
+	return refs
+}
+
+// trimBareURL drops trailing punctuation that belongs to the sentence rather
+// than the URL, following the GFM autolink rules: trailing ?!.,:*_~; and
+// unbalanced closing parentheses or brackets.
+func trimBareURL(u string) string {
+	for len(u) > 0 {
+		last := u[len(u)-1]
+		switch {
+		case strings.IndexByte("?!.,:*_~;", last) >= 0:
+			u = u[:len(u)-1]
+		case last == ')' && strings.Count(u, "(") < strings.Count(u, ")"):
+			u = u[:len(u)-1]
+		case last == ']' && strings.Count(u, "[") < strings.Count(u, "]"):
+			u = u[:len(u)-1]
+		case last == '}' && strings.Count(u, "{") < strings.Count(u, "}"):
+			u = u[:len(u)-1]
+		default:
+			return u
+		}
+	}
+	return u
+}
+
+// isSitePath reports a link relative to the site root, such as /notes/x/y.
+func isSitePath(u string) bool {
+	return strings.HasPrefix(u, "/") && !strings.HasPrefix(u, "//")
+}
+
+func isHTTPURL(u string) bool {
+	return (strings.HasPrefix(u, "http://") || strings.HasPrefix(u, "https://")) && len(u) > len("https://")
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTrimBareURL(t *testing.T) {
+	cases := []struct{ in, want string }{
+		{"https://example.com/a.", "https://example.com/a"},
+		{"https://example.com/a?!", "https://example.com/a"},
+		{"https://example.com/a,", "https://example.com/a"},
+		{"https://example.com/a:", "https://example.com/a"},
+		{"https://example.com/a;", "https://example.com/a"},
+		{"https://example.com/a_*~", "https://example.com/a"},
+		{"https://example.com/a?q=1", "https://example.com/a?q=1"},
+		{"https://example.com/a.html", "https://example.com/a.html"},
+		// Unbalanced closers belong to the sentence, balanced ones to the URL.
+		{"https://example.com/a)", "https://example.com/a"},
+		{"https://example.com/a).", "https://example.com/a"},
+		{"https://en.wikipedia.org/wiki/Go_(game)", "https://en.wikipedia.org/wiki/Go_(game)"},
+		{"https://en.wikipedia.org/wiki/Go_(game)).", "https://en.wikipedia.org/wiki/Go_(game)"},
+		{"https://example.com/a]", "https://example.com/a"},
+		{"https://example.com/a}", "https://example.com/a"},
+	}
+	for _, c := range cases {
+		if got := trimBareURL(c.in); got != c.want {
+			t.Errorf("trimBareURL(%q) = %q, want %q", c.in, got, c.want)
+		}
+	}
+}
+
+func TestScanMarkdownLine(t *testing.T) {
+	cases := []struct {
+		name, line string
+		want       []URLRef
+	}{
+		{"inline", "see [the essay](https://example.com/essay).",
+			[]URLRef{{URL: "https://example.com/essay", Kind: refInline}}},
+		{"inline with title", `[a](https://example.com/a "A title")`,
+			[]URLRef{{URL: "https://example.com/a", Kind: refInline}}},
+		{"inline with parens", "[Go](https://en.wikipedia.org/wiki/Go_(game)) is old",
+			[]URLRef{{URL: "https://en.wikipedia.org/wiki/Go_(game)", Kind: refInline}}},
+		{"inline in angle brackets", "[a](<https://example.com/a b>)",
+			[]URLRef{{URL: "https://example.com/a b", Kind: refInline}}},
+		{"site path", "[notes](/notes/go/tools)",
+			[]URLRef{{URL: "/notes/go/tools", Kind: refInline}}},
+		// The angle brackets are not counted again as an autolink.
+		{"reference definition", "[1]: <https://example.com/ref> \"Ref\"",
+			[]URLRef{{URL: "https://example.com/ref", Kind: refReference}}},
+		{"autolink", "mail me <https://example.com/auto>.",
+			[]URLRef{{URL: "https://example.com/auto", Kind: refAutolink}}},
+		{"jsx", `<Link href="https://example.com/x" /> <img src={'https://example.com/y.png'} />`,
+			[]URLRef{{URL: "https://example.com/x", Kind: refJSX}, {URL: "https://example.com/y.png", Kind: refJSX}}},
+		{"bare with punctuation", "read https://example.com/bare, then https://example.com/wiki/Go_(game).",
+			[]URLRef{{URL: "https://example.com/bare", Kind: refBare}, {URL: "https://example.com/wiki/Go_(game)", Kind: refBare}}},
+		{"bare in parens", "(see https://example.com/aside)",
+			[]URLRef{{URL: "https://example.com/aside", Kind: refBare}}},
+		{"bare site paths are not links", "the /notes/ directory", nil},
+		{"not http", "[mail](mailto:kris@example.com) ftp://example.com/f", nil},
+	}
+	for _, c := range cases {
+		if got := scanMarkdownLine(c.line); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: scanMarkdownLine(%q) = %+v, want %+v", c.name, c.line, got, c.want)
+		}
+	}
+}
+
+func TestStripCodeSpans(t *testing.T) {
+	cases := []struct{ in, want string }{
+		{"no code here", "no code here"},
+		{"run `curl https://a.example/` now", "run " + strings.Repeat(" ", len("`curl https://a.example/`")) + " now"},
+		{"``a `b` c`` d", strings.Repeat(" ", len("``a `b` c``")) + " d"},
+		{"an `unclosed span", "an `unclosed span"},
+	}
+	for _, c := range cases {
+		if got := stripCodeSpans(c.in); got != c.want {
+			t.Errorf("stripCodeSpans(%q) = %q, want %q", c.in, got, c.want)
+		}
+	}
+}
+
+func TestScanMarkdownPositions(t *testing.T) {
+	const doc = "---\n" +
+		"source: https://example.com/front\n" +
+		"---\n" +
+		"Intro with [a link](https://example.com/one).\n" +
+		"```sh\n" +
+		"curl https://example.com/in-fence\n" +
+		"~~~\n" +
+		"still https://example.com/in-fence-too\n" +
+		"```\n" +
+		"````\n" +
+		"```\n" +
+		"https://example.com/nested-fence\n" +
+		"````\n" +
+		"Inline `https://example.com/code` and https://example.com/two.\n"
+	path := filepath.Join(t.TempDir(), "essay.mdx")
+	if err := os.WriteFile(path, []byte(doc), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	refs := extractRefs([]SourceFile{{Path: path, Type: "essays", Slug: "essay"}})
+	want := []URLRef{
+		{URL: "https://example.com/front", File: path, Line: 2, Kind: refFrontmatter, Type: "essays", Slug: "essay"},
+		{URL: "https://example.com/one", File: path, Line: 4, Kind: refInline, Type: "essays", Slug: "essay"},
+		{URL: "https://example.com/two", File: path, Line: 14, Kind: refBare, Type: "essays", Slug: "essay"},
+	}
+	if !reflect.DeepEqual(refs, want) {
+		t.Errorf("refs =\n%+v\nwant\n%+v", refs, want)
+	}
+}
@@ -0,0 +1,84 @@
+// -----------------------------------------------------------------------------
+// File:          url-archiver-git.go
+// Description:   Incremental scanning for URLArchiverV1 (-since). Asks the git
+//                CLI which files changed since a ref, including uncommitted
+//                edits and new untracked files, so only those are scanned.
+// Author:        Kris Yotam
+// License:       CC-0
+// -----------------------------------------------------------------------------
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// gitOutput runs git with args in dir and returns its stdout.
+func gitOutput(dir string, args ...string) ([]byte, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("git %s: %s", args[0], msg)
+		}
+		return nil, fmt.Errorf("git %s: %w", args[0], err)
+	}
+	return out, nil
+}
+
+// changedSince returns the absolute paths of files under dir that were added
+// or modified since ref: committed changes, edits not yet committed, and
+// untracked files git does not ignore. Deleted files are left out.
+func changedSince(dir, ref string) (map[string]bool, error) {
+	top, err := gitOutput(dir, "rev-parse", "--show-toplevel")
+	if err != nil {
+		return nil, err
+	}
+	root := strings.TrimSpace(string(top))
+	if _, err := gitOutput(root, "rev-parse", "--verify", "--quiet", ref+"^{commit}"); err != nil {
+		return nil, fmt.Errorf("unknown ref %q", ref)
+	}
+	diff, err := gitOutput(root, "diff", "--name-only", "-z", "--no-renames", "--diff-filter=d", ref, "--")
+	if err != nil {
+		return nil, err
+	}
+	untracked, err := gitOutput(root, "ls-files", "-z", "--others", "--exclude-standard")
+	if err != nil {
+		return nil, err
+	}
+	changed := make(map[string]bool)
+	for _, out := range [][]byte{diff, untracked} {
+		for _, name := range strings.Split(string(out), "\x00") {
+			if name != "" {
+				changed[filepath.Join(root, filepath.FromSlash(name))] = true
+			}
+		}
+	}
+	return changed, nil
+}
+
+// filterChanged keeps the files whose absolute path is in changed. Symlinks
+// are resolved because git reports paths under the real top-level directory.
+func filterChanged(files []SourceFile, changed map[string]bool) []SourceFile {
+	var kept []SourceFile
+	for _, f := range files {
+		abs, err := filepath.Abs(f.Path)
+		if err != nil {
+			continue
+		}
+		if real, err := filepath.EvalSymlinks(abs); err == nil {
+			abs = real
+		}
+		if changed[abs] {
+			kept = append(kept, f)
+		}
+	}
+	return kept
+}
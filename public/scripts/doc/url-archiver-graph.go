@@ -0,0 +1,255 @@
+// -----------------------------------------------------------------------------
+// File:          url-archiver-graph.go
+// Description:   Outbound link graph for URLArchiverV1 ("graph"). Records which
+//                content page links to which external domains and which of
+//                our own pages, with link counts, and writes it as JSON and
+//                GraphViz DOT to show citation hubs and orphaned pages.
+// Author:        Kris Yotam
+// License:       CC-0
+// -----------------------------------------------------------------------------
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Kinds of graph node.
+const (
+	nodePage     = "page"     // a content item from content.db
+	nodeDomain   = "domain"   // an external host
+	nodeInternal = "internal" // a site path that is not a content item
+)
+
+// GraphNode is a content page, external domain or other site path.
+type GraphNode struct {
+	ID       string `json:"id"`
+	Kind     string `json:"kind"`
+	Label    string `json:"label"`
+	URL      string `json:"url,omitempty"` // site path for pages and internal nodes
+	LinksOut int    `json:"links_out"`
+	LinksIn  int    `json:"links_in"`
+}
+
+// GraphEdge counts the links from one page to a target node.
+type GraphEdge struct {
+	From  string `json:"from"`
+	To    string `json:"to"`
+	Count int    `json:"count"`
+}
+
+// LinkGraph is the exported graph. Orphans are the pages no other page
+// links to.
+type LinkGraph struct {
+	GeneratedAt string      `json:"generated_at"`
+	Nodes       []GraphNode `json:"nodes"`
+	Edges       []GraphEdge `json:"edges"`
+	Orphans     []string    `json:"orphans"`
+}
+
+// pagePath is the site path of a content item, as in dev/sitemap.go.
+func pagePath(it ContentItem) string {
+	return "/" + it.Type + "/" + it.Category + "/" + it.Slug
+}
+
+// siteHost is the host of siteURL without any www. prefix.
+func siteHost(siteURL string) string {
+	u, err := url.Parse(siteURL)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimPrefix(strings.ToLower(u.Hostname()), "www.")
+}
+
+// ownPath reduces link to a decoded site path, without query, fragment or
+// trailing slash, if it is relative or points at host (with or without www.).
+func ownPath(link, host string) (string, bool) {
+	if !isHTTPURL(link) && !isSitePath(link) {
+		return "", false
+	}
+	u, err := url.Parse(link)
+	if err != nil || (u.Host != "" && strings.TrimPrefix(strings.ToLower(u.Hostname()), "www.") != host) {
+		return "", false
+	}
+	p := u.Path
+	if p = strings.TrimSuffix(p, "/"); p == "" {
+		p = "/"
+	}
+	return p, true
+}
+
+// buildLinkGraph turns the links found in the sources of items into a graph.
+func buildLinkGraph(items []ContentItem, links []URLRef, siteURL string) LinkGraph {
+	host := siteHost(siteURL)
+	nodes := make(map[string]*GraphNode)
+	byPath := make(map[string]string)     // site path -> page node ID
+	byTypeSlug := make(map[string]string) // type/slug -> page node ID
+	for _, it := range items {
+		id := it.Type + "/" + it.Slug
+		nodes[id] = &GraphNode{ID: id, Kind: nodePage, Label: it.Title, URL: pagePath(it)}
+		byPath[pagePath(it)] = id
+		byTypeSlug[id] = id
+	}
+	// target resolves a site path to a page, falling back to type/slug so
+	// links with a stale category still count.
+	target := func(p string) (string, string) {
+		if id, ok := byPath[p]; ok {
+			return id, nodePage
+		}
+		if parts := strings.Split(strings.Trim(p, "/"), "/"); len(parts) == 3 {
+			if id, ok := byTypeSlug[parts[0]+"/"+parts[2]]; ok {
+				return id, nodePage
+			}
+		}
+		return "path:" + p, nodeInternal
+	}
+
+	counts := make(map[[2]string]int)
+	for _, r := range links {
+		from := r.Type + "/" + r.Slug
+		if nodes[from] == nil {
+			continue
+		}
+		var to string
+		if p, ok := ownPath(r.URL, host); ok {
+			if path.Ext(p) != "" {
+				continue // a static file such as an image
+			}
+			id, kind := target(p)
+			if id == from {
+				continue
+			}
+			if nodes[id] == nil {
+				nodes[id] = &GraphNode{ID: id, Kind: kind, Label: p, URL: p}
+			}
+			to = id
+		} else if u, err := url.Parse(r.URL); err == nil && isHTTPURL(r.URL) && u.Hostname() != "" {
+			domain := strings.TrimPrefix(strings.ToLower(u.Hostname()), "www.")
+			to = "domain:" + domain
+			if nodes[to] == nil {
+				nodes[to] = &GraphNode{ID: to, Kind: nodeDomain, Label: domain}
+			}
+		} else {
+			continue
+		}
+		counts[[2]string{from, to}]++
+		nodes[from].LinksOut++
+		nodes[to].LinksIn++
+	}
+
+	g := LinkGraph{GeneratedAt: time.Now().UTC().Format(time.RFC3339), Nodes: []GraphNode{}, Edges: []GraphEdge{}, Orphans: []string{}}
+	for _, n := range nodes {
+		g.Nodes = append(g.Nodes, *n)
+		if n.Kind == nodePage && n.LinksIn == 0 {
+			g.Orphans = append(g.Orphans, n.ID)
+		}
+	}
+	for k, c := range counts {
+		g.Edges = append(g.Edges, GraphEdge{From: k[0], To: k[1], Count: c})
+	}
+	sort.Slice(g.Nodes, func(i, j int) bool {
+		if g.Nodes[i].Kind != g.Nodes[j].Kind {
+			return g.Nodes[i].Kind > g.Nodes[j].Kind // page, internal, domain
+		}
+		return g.Nodes[i].ID < g.Nodes[j].ID
+	})
+	sort.Slice(g.Edges, func(i, j int) bool {
+		if g.Edges[i].From != g.Edges[j].From {
+			return g.Edges[i].From < g.Edges[j].From
+		}
+		return g.Edges[i].To < g.Edges[j].To
+	})
+	sort.Strings(g.Orphans)
+	return g
+}
+
+// writeGraphDOT renders g for GraphViz. Pages are boxes, orphans dashed,
+// domains ellipses and other site paths notes; edge width grows with the
+// link count.
+func writeGraphDOT(filename string, g LinkGraph) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	orphan := make(map[string]bool, len(g.Orphans))
+	for _, id := range g.Orphans {
+		orphan[id] = true
+	}
+	fmt.Fprintf(w, "// Link graph generated %s\n", g.GeneratedAt)
+	fmt.Fprintln(w, "digraph links {")
+	fmt.Fprintln(w, "  rankdir=LR;")
+	fmt.Fprintln(w, `  node [fontname="Helvetica", fontsize=10];`)
+	for _, n := range g.Nodes {
+		attrs := fmt.Sprintf("label=%s, tooltip=%s", dotQuote(n.Label), dotQuote(n.ID))
+		switch n.Kind {
+		case nodePage:
+			attrs += ", shape=box"
+			if orphan[n.ID] {
+				attrs += ", style=dashed"
+			}
+		case nodeDomain:
+			attrs += ", shape=ellipse"
+		default:
+			attrs += ", shape=note"
+		}
+		fmt.Fprintf(w, "  %s [%s];\n", dotQuote(n.ID), attrs)
+	}
+	for _, e := range g.Edges {
+		width := 1 + math.Log2(float64(e.Count))
+		fmt.Fprintf(w, "  %s -> %s [label=\"%d\", penwidth=%.1f];\n", dotQuote(e.From), dotQuote(e.To), e.Count, width)
+	}
+	fmt.Fprintln(w, "}")
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// dotQuote quotes s as a DOT string.
+func dotQuote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s) + `"`
+}
+
+// runGraph is the "graph" mode.
+func runGraph(cfg config) {
+	if cfg.Since != "" {
+		log.Fatalf("-since does not apply to graph: orphans need every page scanned")
+	}
+	items, files, err := contentFiles(cfg)
+	if err != nil {
+		log.Fatalf("Failed to collect pages: %v", err)
+	}
+	g := buildLinkGraph(items, extractLinks(files), cfg.SiteURL)
+
+	data, err := json.MarshalIndent(g, "", "  ")
+	if err != nil {
+		log.Fatalf("Graph encode error: %v", err)
+	}
+	jsonPath, dotPath := cfg.GraphPath+".json", cfg.GraphPath+".dot"
+	if err := os.WriteFile(jsonPath, append(data, '\n'), 0644); err != nil {
+		log.Fatalf("Graph write error: %v", err)
+	}
+	if err := writeGraphDOT(dotPath, g); err != nil {
+		log.Fatalf("Graph write error: %v", err)
+	}
+
+	kinds := make(map[string]int)
+	for _, n := range g.Nodes {
+		kinds[n.Kind]++
+	}
+	fmt.Printf("Link graph: %d pages, %d domains, %d other site paths, %d edges, %d orphaned pages\n",
+		kinds[nodePage], kinds[nodeDomain], kinds[nodeInternal], len(g.Edges), len(g.Orphans))
+	fmt.Printf("Wrote %s and %s\n", jsonPath, dotPath)
+}
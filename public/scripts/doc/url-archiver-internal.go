@@ -0,0 +1,284 @@
+// -----------------------------------------------------------------------------
+// File:          url-archiver-internal.go
+// Description:   Internal link validation for URLArchiverV1 ("links"). Resolves
+//                links to our own site, absolute or relative, against the
+//                slugs and categories in content.db, the URL patterns
+//                dev/sitemap.go builds and the App Router pages under src/app,
+//                and reports the broken ones with file and line.
+// Author:        Kris Yotam
+// License:       CC-0
+// -----------------------------------------------------------------------------
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// siteRoutes is every path an internal link may resolve to.
+type siteRoutes struct {
+	exact    map[string]bool
+	hidden   map[string]bool   // content pages whose state is hidden
+	pages    map[string]string // type/slug -> page path, for wrong-category hints
+	owned    map[string]bool   // first segments resolved only from the databases
+	patterns [][]string        // App Router routes with [dynamic] segments
+	static   string            // public/ directory serving files like /images/x.png
+}
+
+// BrokenLink is an internal link that resolves to nothing.
+type BrokenLink struct {
+	Ref    URLRef
+	Path   string
+	Reason string
+}
+
+// querySlugs runs a one-column query and returns the non-empty values.
+func querySlugs(db *sql.DB, query string) ([]string, error) {
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []string
+	for rows.Next() {
+		var s sql.NullString
+		if err := rows.Scan(&s); err != nil {
+			return nil, err
+		}
+		if s.String != "" {
+			out = append(out, s.String)
+		}
+	}
+	return out, rows.Err()
+}
+
+// loadSiteRoutes builds the route table from content.db (every type and
+// state, since any page may be linked to), the App Router tree in appDir
+// and the public directory.
+func loadSiteRoutes(dbPath, appDir, publicDir string) (*siteRoutes, error) {
+	rt := &siteRoutes{
+		exact:  map[string]bool{"/": true},
+		hidden: make(map[string]bool),
+		pages:  make(map[string]string),
+		owned:  map[string]bool{"sequences": true, "category": true, "tag": true},
+		static: publicDir,
+	}
+
+	items, err := loadContent(dbPath, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	types := make(map[string]bool)
+	for _, it := range items {
+		types[it.Type] = true
+		p := pagePath(it)
+		rt.pages[it.Type+"/"+it.Slug] = p
+		if it.State == "hidden" {
+			rt.hidden[p] = true
+			continue
+		}
+		rt.exact[p] = true
+		rt.exact["/"+it.Type+"/"+it.Category] = true
+	}
+
+	db, err := sql.Open("sqlite3", "file:"+dbPath+"?mode=ro")
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	tags, err := querySlugs(db, `SELECT slug FROM tags`)
+	if err != nil {
+		return nil, fmt.Errorf("tags: %w", err)
+	}
+	for t := range types {
+		rt.owned[t] = true
+		for _, p := range []string{"", "/categories", "/tags"} {
+			rt.exact["/"+t+p] = true
+		}
+		for _, tag := range tags {
+			rt.exact["/"+t+"/tag/"+tag] = true
+		}
+	}
+	for _, tag := range tags {
+		rt.exact["/tag/"+tag] = true
+	}
+	cats, err := querySlugs(db, `SELECT slug FROM categories`)
+	if err != nil {
+		return nil, fmt.Errorf("categories: %w", err)
+	}
+	for _, c := range cats {
+		rt.exact["/category/"+c] = true
+	}
+	seqs, err := querySlugs(db, `SELECT slug FROM sequences WHERE COALESCE(state, '') != 'hidden'`)
+	if err != nil {
+		return nil, fmt.Errorf("sequences: %w", err)
+	}
+	for _, s := range seqs {
+		rt.exact["/sequences/"+s] = true
+	}
+	seqCats, err := querySlugs(db, `SELECT DISTINCT category_slug FROM sequences`)
+	if err != nil {
+		return nil, fmt.Errorf("sequences: %w", err)
+	}
+	for _, c := range seqCats {
+		rt.exact["/sequences/category/"+c] = true
+	}
+
+	if err := rt.loadAppRoutes(appDir); err != nil {
+		return nil, fmt.Errorf("%s: %w", appDir, err)
+	}
+	return rt, nil
+}
+
+// loadAppRoutes adds the pages of a Next.js App Router tree: static routes
+// as exact paths and dynamic ones as patterns. Route groups like (content)
+// are dropped from the path; private _folders and api routes are skipped.
+func (rt *siteRoutes) loadAppRoutes(appDir string) error {
+	return filepath.WalkDir(appDir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		name := d.Name()
+		if d.IsDir() {
+			if p != appDir && (strings.HasPrefix(name, "_") || strings.HasPrefix(name, "@") || name == "api") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if ext := filepath.Ext(name); strings.TrimSuffix(name, ext) != "page" {
+			return nil
+		}
+		rel, err := filepath.Rel(appDir, filepath.Dir(p))
+		if err != nil {
+			return err
+		}
+		var segs []string
+		dynamic := false
+		for _, s := range strings.Split(filepath.ToSlash(rel), "/") {
+			if s == "." || (strings.HasPrefix(s, "(") && strings.HasSuffix(s, ")")) {
+				continue
+			}
+			dynamic = dynamic || strings.HasPrefix(s, "[")
+			segs = append(segs, s)
+		}
+		switch {
+		case !dynamic:
+			rt.exact["/"+strings.Join(segs, "/")] = true
+		case !strings.HasPrefix(segs[0], "["):
+			// A leading [type] segment would match anything; content
+			// types are resolved from content.db instead.
+			rt.patterns = append(rt.patterns, segs)
+		}
+		return nil
+	})
+}
+
+// matchRoute reports whether segs fits an App Router pattern.
+func matchRoute(pattern, segs []string) bool {
+	for i, p := range pattern {
+		switch {
+		case strings.HasPrefix(p, "[[..."):
+			return true
+		case strings.HasPrefix(p, "[..."):
+			return len(segs) > i
+		case i >= len(segs):
+			return false
+		case strings.HasPrefix(p, "["):
+		case p != segs[i]:
+			return false
+		}
+	}
+	return len(pattern) == len(segs)
+}
+
+// Resolve returns why p is broken, or "" if it resolves.
+func (rt *siteRoutes) Resolve(p string) string {
+	if path.Ext(p) != "" {
+		if _, err := os.Stat(filepath.Join(rt.static, filepath.FromSlash(p))); err != nil {
+			return "no such file under " + rt.static
+		}
+		return ""
+	}
+	if rt.exact[p] {
+		return ""
+	}
+	if rt.hidden[p] {
+		return "page is hidden"
+	}
+	segs := strings.Split(strings.TrimPrefix(p, "/"), "/")
+	if rt.owned[segs[0]] {
+		if len(segs) == 3 {
+			if want, ok := rt.pages[segs[0]+"/"+segs[2]]; ok {
+				return "wrong category, page is at " + want
+			}
+		}
+		return "not in content.db"
+	}
+	for _, pattern := range rt.patterns {
+		if matchRoute(pattern, segs) {
+			return ""
+		}
+	}
+	return "no such page"
+}
+
+// checkInternalLinks resolves every internal link in refs.
+func checkInternalLinks(refs []URLRef, host string, rt *siteRoutes) (broken []BrokenLink, checked int) {
+	for _, r := range refs {
+		p, ok := ownPath(r.URL, host)
+		if !ok {
+			continue
+		}
+		checked++
+		if reason := rt.Resolve(p); reason != "" {
+			broken = append(broken, BrokenLink{Ref: r, Path: p, Reason: reason})
+		}
+	}
+	sort.Slice(broken, func(i, j int) bool {
+		if broken[i].Ref.File != broken[j].Ref.File {
+			return broken[i].Ref.File < broken[j].Ref.File
+		}
+		return broken[i].Ref.Line < broken[j].Ref.Line
+	})
+	return broken, checked
+}
+
+// runLinks is the "links" mode. It exits with status 1 when any internal
+// link is broken, so it can gate a commit or deploy.
+func runLinks(cfg config) {
+	_, files, err := contentFiles(cfg)
+	if err != nil {
+		log.Fatalf("Failed to collect pages: %v", err)
+	}
+	rt, err := loadSiteRoutes(cfg.ContentDB, cfg.AppDir, cfg.PublicDir)
+	if err != nil {
+		log.Fatalf("Failed to load site routes: %v", err)
+	}
+	broken, checked := checkInternalLinks(extractLinks(files), siteHost(cfg.SiteURL), rt)
+
+	f, err := os.Create(cfg.ReportPath)
+	if err != nil {
+		log.Fatalf("Report create error: %v", err)
+	}
+	defer f.Close()
+	for _, b := range broken {
+		line := fmt.Sprintf("%s:%d: %s/%s links to %s: %s", b.Ref.File, b.Ref.Line, b.Ref.Type, b.Ref.Slug, b.Ref.URL, b.Reason)
+		fmt.Println(line)
+		f.WriteString(line + "\n")
+	}
+	f.WriteString(fmt.Sprintf("\n# internal links checked: %d\n# broken: %d\n", checked, len(broken)))
+
+	fmt.Printf("Links complete: %d broken of %d internal links in %d files. Report: %s\n", len(broken), checked, len(files), cfg.ReportPath)
+	if len(broken) > 0 {
+		f.Close()
+		os.Exit(1)
+	}
+}
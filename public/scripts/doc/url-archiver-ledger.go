@@ -0,0 +1,706 @@
+// -----------------------------------------------------------------------------
+// File:          url-archiver-ledger.go
+// Description:   Persistent SQLite ledger of archive submissions for URLArchiverV1
+// Author:        Kris Yotam
+// License:       CC-0
+// -----------------------------------------------------------------------------
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// ledgerTimeLayout matches SQLite's datetime('now') so the ledger sorts and
+// compares the same way as the other public/data databases.
+const ledgerTimeLayout = "2006-01-02 15:04:05"
+
+const ledgerSchema = `
+CREATE TABLE IF NOT EXISTS archive_ledger (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  url TEXT NOT NULL,
+  service TEXT NOT NULL,
+  snapshot_url TEXT,
+  snapshot_at TEXT,
+  first_archived_at TEXT,
+  last_archived_at TEXT,
+  last_attempt_at TEXT,
+  last_error TEXT,
+  UNIQUE(url, service)
+);
+CREATE INDEX IF NOT EXISTS idx_archive_ledger_url ON archive_ledger(url);
+CREATE INDEX IF NOT EXISTS idx_archive_ledger_service ON archive_ledger(service);
+CREATE TABLE IF NOT EXISTS archive_snapshots (
+  url TEXT NOT NULL,
+  service TEXT NOT NULL,
+  snapshot_url TEXT NOT NULL,
+  snapshot_at TEXT NOT NULL,
+  verified INTEGER NOT NULL DEFAULT 0,
+  UNIQUE(url, service, snapshot_url)
+);
+CREATE INDEX IF NOT EXISTS idx_archive_snapshots_url ON archive_snapshots(url);
+CREATE TABLE IF NOT EXISTS archive_runs (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  started_at TEXT NOT NULL,
+  finished_at TEXT,
+  status TEXT NOT NULL DEFAULT 'running'
+);
+CREATE TABLE IF NOT EXISTS archive_run_jobs (
+  run_id INTEGER NOT NULL,
+  url TEXT NOT NULL,
+  service TEXT NOT NULL,
+  done INTEGER NOT NULL DEFAULT 0,
+  PRIMARY KEY (run_id, url, service),
+  FOREIGN KEY (run_id) REFERENCES archive_runs(id) ON DELETE CASCADE
+);
+CREATE TABLE IF NOT EXISTS archive_queue (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  url TEXT NOT NULL,
+  service TEXT NOT NULL,
+  state TEXT NOT NULL DEFAULT 'queued',
+  enqueued_at TEXT NOT NULL,
+  started_at TEXT,
+  finished_at TEXT,
+  snapshot_url TEXT,
+  error TEXT
+);
+CREATE INDEX IF NOT EXISTS idx_archive_queue_state ON archive_queue(state, id);
+CREATE INDEX IF NOT EXISTS idx_archive_queue_url ON archive_queue(url);
+CREATE TABLE IF NOT EXISTS link_checks (
+  url TEXT PRIMARY KEY,
+  checked_at TEXT NOT NULL,
+  status TEXT NOT NULL,
+  http_status INTEGER,
+  final_url TEXT,
+  redirects TEXT,
+  error TEXT,
+  first_broken_at TEXT,
+  broken_streak INTEGER NOT NULL DEFAULT 0
+);
+CREATE TABLE IF NOT EXISTS page_baselines (
+  url TEXT PRIMARY KEY,
+  hash TEXT NOT NULL,
+  sketch TEXT NOT NULL,
+  captured_at TEXT NOT NULL,
+  checked_at TEXT,
+  current_hash TEXT,
+  similarity REAL
+);
+CREATE TABLE IF NOT EXISTS mirrored_documents (
+  url TEXT PRIMARY KEY,
+  sha256 TEXT NOT NULL,
+  bucket TEXT NOT NULL,
+  key TEXT NOT NULL,
+  size INTEGER NOT NULL,
+  content_type TEXT NOT NULL,
+  mirrored_at TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_mirrored_documents_sha256 ON mirrored_documents(sha256);
+`
+
+// Ledger records every URL submitted to an archival service so reruns only
+// resubmit URLs that are new, previously failed, or whose snapshot is stale.
+type Ledger struct {
+	db *sql.DB
+}
+
+// LedgerEntry is one row of the archive_ledger table.
+type LedgerEntry struct {
+	URL             string
+	Service         string
+	SnapshotURL     string
+	SnapshotAt      time.Time // memento timestamp of SnapshotURL, when known
+	FirstArchivedAt time.Time
+	LastArchivedAt  time.Time
+	LastAttemptAt   time.Time
+	LastError       string
+}
+
+func openLedger(path string) (*Ledger, error) {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(ledgerSchema); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Ledger{db: db}, nil
+}
+
+func (l *Ledger) Close() error {
+	return l.db.Close()
+}
+
+// Lookup returns the ledger entry for url on service, or nil if the URL has
+// never been submitted there.
+func (l *Ledger) Lookup(url, service string) (*LedgerEntry, error) {
+	var snapshot, snapshotAt, first, last, attempt, lastErr sql.NullString
+	err := l.db.QueryRow(`
+		SELECT snapshot_url, snapshot_at, first_archived_at, last_archived_at, last_attempt_at, last_error
+		FROM archive_ledger WHERE url = ? AND service = ?`, url, service,
+	).Scan(&snapshot, &snapshotAt, &first, &last, &attempt, &lastErr)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &LedgerEntry{
+		URL:             url,
+		Service:         service,
+		SnapshotURL:     snapshot.String,
+		SnapshotAt:      parseLedgerTime(snapshotAt),
+		FirstArchivedAt: parseLedgerTime(first),
+		LastArchivedAt:  parseLedgerTime(last),
+		LastAttemptAt:   parseLedgerTime(attempt),
+		LastError:       lastErr.String,
+	}, nil
+}
+
+// Due filters urls down to those that need submitting to service: never seen,
+// never successfully archived, or last archived more than maxAge ago. A
+// non-positive maxAge resubmits everything.
+func (l *Ledger) Due(urls []string, service string, maxAge time.Duration, now time.Time) ([]string, error) {
+	if maxAge <= 0 {
+		return urls, nil
+	}
+	due := make([]string, 0, len(urls))
+	for _, u := range urls {
+		entry, err := l.Lookup(u, service)
+		if err != nil {
+			return nil, err
+		}
+		if entry == nil || entry.LastArchivedAt.IsZero() || now.Sub(entry.LastArchivedAt) > maxAge {
+			due = append(due, u)
+		}
+	}
+	return due, nil
+}
+
+// Record upserts the outcome of one archive attempt. Failures only touch the
+// attempt time and error so an earlier good snapshot is never lost. Every
+// snapshot is also kept in archive_snapshots for TimeMaps.
+func (l *Ledger) Record(r ArchiveResult, at time.Time) error {
+	ts := at.UTC().Format(ledgerTimeLayout)
+	if r.Archived {
+		var snapshotAt sql.NullString
+		if !r.SnapshotAt.IsZero() {
+			snapshotAt = sql.NullString{String: r.SnapshotAt.UTC().Format(ledgerTimeLayout), Valid: true}
+		}
+		if r.SnapshotURL != "" {
+			_, err := l.db.Exec(`
+				INSERT INTO archive_snapshots (url, service, snapshot_url, snapshot_at, verified) VALUES (?, ?, ?, COALESCE(?, ?), ?)
+				ON CONFLICT(url, service, snapshot_url) DO UPDATE SET verified = MAX(verified, excluded.verified)`,
+				r.URL, r.Service, r.SnapshotURL, snapshotAt, ts, r.Verified)
+			if err != nil {
+				return err
+			}
+		}
+		_, err := l.db.Exec(`
+			INSERT INTO archive_ledger (url, service, snapshot_url, snapshot_at, first_archived_at, last_archived_at, last_attempt_at, last_error)
+			VALUES (?, ?, ?, ?, ?, ?, ?, NULL)
+			ON CONFLICT(url, service) DO UPDATE SET
+			  snapshot_at = CASE WHEN COALESCE(excluded.snapshot_url, '') = '' THEN snapshot_at ELSE excluded.snapshot_at END,
+			  snapshot_url = COALESCE(NULLIF(excluded.snapshot_url, ''), snapshot_url),
+			  first_archived_at = COALESCE(first_archived_at, excluded.first_archived_at),
+			  last_archived_at = excluded.last_archived_at,
+			  last_attempt_at = excluded.last_attempt_at,
+			  last_error = NULL`,
+			r.URL, r.Service, r.SnapshotURL, snapshotAt, ts, ts, ts)
+		return err
+	}
+	errText := "not archived"
+	if r.Error != nil {
+		errText = r.Error.Error()
+	}
+	_, err := l.db.Exec(`
+		INSERT INTO archive_ledger (url, service, last_attempt_at, last_error)
+		VALUES (?, ?, ?, ?)
+		ON CONFLICT(url, service) DO UPDATE SET
+		  last_attempt_at = excluded.last_attempt_at,
+		  last_error = excluded.last_error`,
+		r.URL, r.Service, ts, errText)
+	return err
+}
+
+func parseLedgerTime(s sql.NullString) time.Time {
+	if !s.Valid || s.String == "" {
+		return time.Time{}
+	}
+	t, err := time.ParseInLocation(ledgerTimeLayout, s.String, time.UTC)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+// -----------------------------------------------------------------------------
+// Runs
+// -----------------------------------------------------------------------------
+
+// Run statuses stored in archive_runs.status.
+const (
+	runRunning     = "running"
+	runComplete    = "complete"
+	runInterrupted = "interrupted"
+)
+
+// RunJob is one URL/service pair queued in a run.
+type RunJob struct {
+	URL     string
+	Service string
+}
+
+// StartRun records a new run and its full job list so an interrupted run can
+// be picked up again with -resume.
+func (l *Ledger) StartRun(jobs []RunJob, at time.Time) (int64, error) {
+	tx, err := l.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec(`INSERT INTO archive_runs (started_at, status) VALUES (?, ?)`,
+		at.UTC().Format(ledgerTimeLayout), runRunning)
+	if err != nil {
+		return 0, err
+	}
+	runID, err := res.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	stmt, err := tx.Prepare(`INSERT OR IGNORE INTO archive_run_jobs (run_id, url, service) VALUES (?, ?, ?)`)
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Close()
+	for _, j := range jobs {
+		if _, err := stmt.Exec(runID, j.URL, j.Service); err != nil {
+			return 0, err
+		}
+	}
+	return runID, tx.Commit()
+}
+
+// MarkJobDone flags one job of a run as finished, successful or not.
+func (l *Ledger) MarkJobDone(runID int64, j RunJob) error {
+	_, err := l.db.Exec(`UPDATE archive_run_jobs SET done = 1 WHERE run_id = ? AND url = ? AND service = ?`,
+		runID, j.URL, j.Service)
+	return err
+}
+
+// FinishRun stamps a run with its final status.
+func (l *Ledger) FinishRun(runID int64, status string, at time.Time) error {
+	_, err := l.db.Exec(`UPDATE archive_runs SET status = ?, finished_at = ? WHERE id = ?`,
+		status, at.UTC().Format(ledgerTimeLayout), runID)
+	return err
+}
+
+// LastUnfinishedRun returns the most recent run, if it did not complete, along
+// with its outstanding jobs, and marks it running again. runID is 0 when
+// there is nothing to resume.
+func (l *Ledger) LastUnfinishedRun() (int64, []RunJob, error) {
+	var runID int64
+	var status string
+	err := l.db.QueryRow(`SELECT id, status FROM archive_runs ORDER BY id DESC LIMIT 1`).Scan(&runID, &status)
+	if err == sql.ErrNoRows || status == runComplete {
+		return 0, nil, nil
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+	if _, err := l.db.Exec(`UPDATE archive_runs SET status = ?, finished_at = NULL WHERE id = ?`, runRunning, runID); err != nil {
+		return 0, nil, err
+	}
+	rows, err := l.db.Query(`SELECT url, service FROM archive_run_jobs WHERE run_id = ? AND done = 0 ORDER BY service, url`, runID)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer rows.Close()
+	var jobs []RunJob
+	for rows.Next() {
+		var j RunJob
+		if err := rows.Scan(&j.URL, &j.Service); err != nil {
+			return 0, nil, err
+		}
+		jobs = append(jobs, j)
+	}
+	return runID, jobs, rows.Err()
+}
+
+// -----------------------------------------------------------------------------
+// Daemon queue
+// -----------------------------------------------------------------------------
+
+// Queue job states stored in archive_queue.state.
+const (
+	jobQueued  = "queued"
+	jobRunning = "running"
+	jobDone    = "done"
+	jobFailed  = "failed"
+)
+
+// QueueJob is one URL/service submission waiting in or taken from the
+// daemon's queue. Times are RFC 3339 for the HTTP API.
+type QueueJob struct {
+	ID          int64  `json:"id"`
+	URL         string `json:"url"`
+	Service     string `json:"service"`
+	State       string `json:"state"`
+	EnqueuedAt  string `json:"enqueued_at"`
+	StartedAt   string `json:"started_at,omitempty"`
+	FinishedAt  string `json:"finished_at,omitempty"`
+	SnapshotURL string `json:"snapshot_url,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+const queueColumns = `id, url, service, state, enqueued_at, COALESCE(started_at, ''), COALESCE(finished_at, ''), COALESCE(snapshot_url, ''), COALESCE(error, '')`
+
+func scanQueueJobs(rows *sql.Rows) ([]QueueJob, error) {
+	defer rows.Close()
+	var jobs []QueueJob
+	for rows.Next() {
+		var j QueueJob
+		if err := rows.Scan(&j.ID, &j.URL, &j.Service, &j.State, &j.EnqueuedAt, &j.StartedAt, &j.FinishedAt, &j.SnapshotURL, &j.Error); err != nil {
+			return nil, err
+		}
+		for _, ts := range []*string{&j.EnqueuedAt, &j.StartedAt, &j.FinishedAt} {
+			if t := parseLedgerTime(sql.NullString{String: *ts, Valid: true}); !t.IsZero() {
+				*ts = t.Format(time.RFC3339)
+			}
+		}
+		jobs = append(jobs, j)
+	}
+	return jobs, rows.Err()
+}
+
+// Enqueue adds a job for url on service, or returns the one already queued
+// or running for that pair so repeated pastes do not pile up.
+func (l *Ledger) Enqueue(url, service string, at time.Time) (QueueJob, error) {
+	rows, err := l.db.Query(`SELECT `+queueColumns+` FROM archive_queue
+		WHERE url = ? AND service = ? AND state IN (?, ?) ORDER BY id LIMIT 1`, url, service, jobQueued, jobRunning)
+	if err != nil {
+		return QueueJob{}, err
+	}
+	existing, err := scanQueueJobs(rows)
+	if err != nil {
+		return QueueJob{}, err
+	}
+	if len(existing) > 0 {
+		return existing[0], nil
+	}
+	ts := at.UTC().Format(ledgerTimeLayout)
+	res, err := l.db.Exec(`INSERT INTO archive_queue (url, service, state, enqueued_at) VALUES (?, ?, ?, ?)`,
+		url, service, jobQueued, ts)
+	if err != nil {
+		return QueueJob{}, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return QueueJob{}, err
+	}
+	return QueueJob{ID: id, URL: url, Service: service, State: jobQueued, EnqueuedAt: at.UTC().Format(time.RFC3339)}, nil
+}
+
+// ClaimJob marks the oldest queued job running and returns it, or nil when
+// no queued job is left for a service outside skip.
+func (l *Ledger) ClaimJob(at time.Time, skip ...string) (*QueueJob, error) {
+	query, args := `SELECT `+queueColumns+` FROM archive_queue WHERE state = ?`, []any{jobQueued}
+	if len(skip) > 0 {
+		query += ` AND service NOT IN (?` + strings.Repeat(`, ?`, len(skip)-1) + `)`
+		for _, s := range skip {
+			args = append(args, s)
+		}
+	}
+	rows, err := l.db.Query(query+` ORDER BY id LIMIT 1`, args...)
+	if err != nil {
+		return nil, err
+	}
+	jobs, err := scanQueueJobs(rows)
+	if err != nil || len(jobs) == 0 {
+		return nil, err
+	}
+	j := jobs[0]
+	if _, err := l.db.Exec(`UPDATE archive_queue SET state = ?, started_at = ? WHERE id = ?`, jobRunning, at.UTC().Format(ledgerTimeLayout), j.ID); err != nil {
+		return nil, err
+	}
+	j.State, j.StartedAt = jobRunning, at.UTC().Format(time.RFC3339)
+	return &j, nil
+}
+
+// FinishJob stores the outcome of a claimed job.
+func (l *Ledger) FinishJob(id int64, r ArchiveResult, at time.Time) error {
+	state, errText := jobDone, ""
+	if !r.Archived {
+		state, errText = jobFailed, "not archived"
+		if r.Error != nil {
+			errText = r.Error.Error()
+		}
+	}
+	_, err := l.db.Exec(`UPDATE archive_queue SET state = ?, finished_at = ?, snapshot_url = NULLIF(?, ''), error = NULLIF(?, '') WHERE id = ?`,
+		state, at.UTC().Format(ledgerTimeLayout), r.SnapshotURL, errText, id)
+	return err
+}
+
+// RequeueRunning puts jobs left running by a crash or shutdown back in the
+// queue, or just job id when id is non-zero. It returns how many moved.
+func (l *Ledger) RequeueRunning(id int64) (int64, error) {
+	query, args := `UPDATE archive_queue SET state = ?, started_at = NULL WHERE state = ?`, []any{jobQueued, jobRunning}
+	if id != 0 {
+		query += ` AND id = ?`
+		args = append(args, id)
+	}
+	res, err := l.db.Exec(query, args...)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// QueueJobs lists the jobs for url, newest first, or when url is empty the
+// queued and running jobs, oldest first.
+func (l *Ledger) QueueJobs(url string) ([]QueueJob, error) {
+	var rows *sql.Rows
+	var err error
+	if url == "" {
+		rows, err = l.db.Query(`SELECT `+queueColumns+` FROM archive_queue WHERE state IN (?, ?) ORDER BY id`, jobQueued, jobRunning)
+	} else {
+		rows, err = l.db.Query(`SELECT `+queueColumns+` FROM archive_queue WHERE url = ? ORDER BY id DESC`, url)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return scanQueueJobs(rows)
+}
+
+// QueueJobByID returns one job, or nil if there is none with that id.
+func (l *Ledger) QueueJobByID(id int64) (*QueueJob, error) {
+	rows, err := l.db.Query(`SELECT `+queueColumns+` FROM archive_queue WHERE id = ?`, id)
+	if err != nil {
+		return nil, err
+	}
+	jobs, err := scanQueueJobs(rows)
+	if err != nil || len(jobs) == 0 {
+		return nil, err
+	}
+	return &jobs[0], nil
+}
+
+// QueueCounts returns the number of jobs in each state.
+func (l *Ledger) QueueCounts() (map[string]int, error) {
+	rows, err := l.db.Query(`SELECT state, COUNT(*) FROM archive_queue GROUP BY state`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	counts := make(map[string]int)
+	for rows.Next() {
+		var state string
+		var n int
+		if err := rows.Scan(&state, &n); err != nil {
+			return nil, err
+		}
+		counts[state] = n
+	}
+	return counts, rows.Err()
+}
+
+// -----------------------------------------------------------------------------
+// Link checks
+// -----------------------------------------------------------------------------
+
+// RecordCheck stores the latest check of a URL. broken_streak counts
+// consecutive broken results so one flaky probe is not mistaken for a dead
+// link; first_broken_at marks when the current streak began.
+func (l *Ledger) RecordCheck(c CheckResult, at time.Time) error {
+	ts := at.UTC().Format(ledgerTimeLayout)
+	var errText sql.NullString
+	if c.Error != nil {
+		errText = sql.NullString{String: c.Error.Error(), Valid: true}
+	}
+	broken := 0
+	if c.Broken() {
+		broken = 1
+	}
+	_, err := l.db.Exec(`
+		INSERT INTO link_checks (url, checked_at, status, http_status, final_url, redirects, error, first_broken_at, broken_streak)
+		VALUES (?, ?, ?, ?, ?, ?, ?, CASE WHEN ? = 1 THEN ? END, ?)
+		ON CONFLICT(url) DO UPDATE SET
+		  checked_at = excluded.checked_at,
+		  status = excluded.status,
+		  http_status = excluded.http_status,
+		  final_url = excluded.final_url,
+		  redirects = excluded.redirects,
+		  error = excluded.error,
+		  first_broken_at = CASE WHEN ? = 1 THEN COALESCE(first_broken_at, excluded.first_broken_at) END,
+		  broken_streak = CASE WHEN ? = 1 THEN broken_streak + 1 ELSE 0 END`,
+		c.URL, ts, c.Status, c.HTTPStatus, c.FinalURL, strings.Join(c.Redirects, "\n"), errText,
+		broken, ts, broken, broken, broken)
+	return err
+}
+
+// DeadLink is a URL the check mode has seen broken on consecutive runs.
+type DeadLink struct {
+	URL           string
+	Status        string
+	FirstBrokenAt time.Time
+}
+
+// ConfirmedDead lists URLs whose last minStreak or more checks were all
+// broken, ordered by URL.
+func (l *Ledger) ConfirmedDead(minStreak int) ([]DeadLink, error) {
+	if minStreak < 1 {
+		minStreak = 1
+	}
+	rows, err := l.db.Query(`SELECT url, status, first_broken_at FROM link_checks
+		WHERE broken_streak >= ? ORDER BY url`, minStreak)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var dead []DeadLink
+	for rows.Next() {
+		var d DeadLink
+		var first sql.NullString
+		if err := rows.Scan(&d.URL, &d.Status, &first); err != nil {
+			return nil, err
+		}
+		d.FirstBrokenAt = parseLedgerTime(first)
+		dead = append(dead, d)
+	}
+	return dead, rows.Err()
+}
+
+// -----------------------------------------------------------------------------
+// Content baselines
+// -----------------------------------------------------------------------------
+
+// PageBaseline is the fingerprint a cited page had when first archived.
+type PageBaseline struct {
+	URL         string
+	Fingerprint Fingerprint
+	CapturedAt  time.Time
+}
+
+// Baseline returns the stored baseline for url, or nil if there is none.
+func (l *Ledger) Baseline(url string) (*PageBaseline, error) {
+	var hash, sketch string
+	var captured sql.NullString
+	err := l.db.QueryRow(`SELECT hash, sketch, captured_at FROM page_baselines WHERE url = ?`, url).
+		Scan(&hash, &sketch, &captured)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	values, err := decodeSketch(sketch)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", url, err)
+	}
+	return &PageBaseline{URL: url, Fingerprint: Fingerprint{Hash: hash, Sketch: values}, CapturedAt: parseLedgerTime(captured)}, nil
+}
+
+// SaveBaseline stores fp as url's baseline unless one already exists.
+func (l *Ledger) SaveBaseline(url string, fp Fingerprint, at time.Time) error {
+	_, err := l.db.Exec(`
+		INSERT INTO page_baselines (url, hash, sketch, captured_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT(url) DO NOTHING`,
+		url, fp.Hash, encodeSketch(fp.Sketch), at.UTC().Format(ledgerTimeLayout))
+	return err
+}
+
+// RecordDrift stores the latest comparison of url against its baseline.
+func (l *Ledger) RecordDrift(url string, fp Fingerprint, sim float64, at time.Time) error {
+	_, err := l.db.Exec(`UPDATE page_baselines SET checked_at = ?, current_hash = ?, similarity = ? WHERE url = ?`,
+		at.UTC().Format(ledgerTimeLayout), fp.Hash, sim, url)
+	return err
+}
+
+// -----------------------------------------------------------------------------
+// Document mirror
+// -----------------------------------------------------------------------------
+
+// Mirrored returns where url's document was mirrored, or nil if it was not.
+func (l *Ledger) Mirrored(url string) (*MirroredDoc, error) {
+	d := MirroredDoc{URL: url}
+	err := l.db.QueryRow(`SELECT sha256, bucket, key, size, content_type FROM mirrored_documents WHERE url = ?`, url).
+		Scan(&d.SHA256, &d.Bucket, &d.Key, &d.Size, &d.ContentType)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+// RecordMirror stores where d.URL's document was mirrored.
+func (l *Ledger) RecordMirror(d MirroredDoc, at time.Time) error {
+	_, err := l.db.Exec(`
+		INSERT INTO mirrored_documents (url, sha256, bucket, key, size, content_type, mirrored_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(url) DO UPDATE SET
+		  sha256 = excluded.sha256, bucket = excluded.bucket, key = excluded.key,
+		  size = excluded.size, content_type = excluded.content_type, mirrored_at = excluded.mirrored_at`,
+		d.URL, d.SHA256, d.Bucket, d.Key, d.Size, d.ContentType, at.UTC().Format(ledgerTimeLayout))
+	return err
+}
+
+// -----------------------------------------------------------------------------
+// Snapshot history
+// -----------------------------------------------------------------------------
+
+// Memento is one known snapshot of a URL.
+type Memento struct {
+	Service  string
+	URI      string
+	Datetime time.Time
+}
+
+// Snapshotted returns the set of URLs with at least one verified snapshot.
+// Captures of error pages and submissions a service accepted without
+// confirming a capture do not count.
+func (l *Ledger) Snapshotted() (map[string]bool, error) {
+	rows, err := l.db.Query(`SELECT DISTINCT url FROM archive_snapshots WHERE verified = 1`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make(map[string]bool)
+	for rows.Next() {
+		var u string
+		if err := rows.Scan(&u); err != nil {
+			return nil, err
+		}
+		out[u] = true
+	}
+	return out, rows.Err()
+}
+
+// Mementos lists every snapshot recorded for url, oldest first.
+func (l *Ledger) Mementos(url string) ([]Memento, error) {
+	rows, err := l.db.Query(`
+		SELECT service, snapshot_url, snapshot_at FROM archive_snapshots WHERE url = ?
+		ORDER BY snapshot_at, service, snapshot_url`, url)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []Memento
+	for rows.Next() {
+		var m Memento
+		var at sql.NullString
+		if err := rows.Scan(&m.Service, &m.URI, &at); err != nil {
+			return nil, err
+		}
+		m.Datetime = parseLedgerTime(at)
+		out = append(out, m)
+	}
+	return out, rows.Err()
+}
@@ -0,0 +1,351 @@
+// -----------------------------------------------------------------------------
+// File:          url-archiver-mirror.go
+// Description:   Local mirroring of cited documents for URLArchiverV1. Links
+//                that turn out to be PDFs (or other documents, judged by
+//                content type) are downloaded under a size limit, stored once
+//                per SHA-256 in the mirror directory and registered in
+//                storage.db's buckets/objects catalog with original_url set,
+//                ready for sync.sh to push to object storage. Runs after
+//                archive runs and, for older citations, as the "mirror" mode.
+//
+//                Object keys are the file paths relative to the repository
+//                root, which is what sync.sh uploads a section as, so the
+//                default -mirrorDir mirror/docs syncs with a section like:
+//
+//                  [mirror-docs]
+//                  path = mirror
+//                  slug = docs
+//                  bucket = doc
+//
+//                public_url uses the same bucket roots as doc.py.
+// Author:        Kris Yotam
+// License:       CC-0
+// -----------------------------------------------------------------------------
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// documentTypes maps the content types worth mirroring to the extension
+// their files get.
+var documentTypes = map[string]string{
+	"application/pdf":               ".pdf",
+	"application/x-pdf":             ".pdf",
+	"application/postscript":        ".ps",
+	"application/epub+zip":          ".epub",
+	"application/msword":            ".doc",
+	"application/rtf":               ".rtf",
+	"application/vnd.ms-powerpoint": ".ppt",
+	"application/vnd.openxmlformats-officedocument.wordprocessingml.document":   ".docx",
+	"application/vnd.openxmlformats-officedocument.presentationml.presentation": ".pptx",
+	"application/vnd.oasis.opendocument.text":                                   ".odt",
+	"image/vnd.djvu": ".djvu",
+	"image/x-djvu":   ".djvu",
+}
+
+// bucketRoots are the site paths object storage buckets are served under,
+// as in doc.py. Other buckets fall back to /doc.
+var bucketRoots = map[string]string{
+	"doc":            "/doc",
+	"src":            "/src",
+	"public-archive": "/archive",
+	"public_archive": "/archive",
+}
+
+// A download may take mirrorBaseTimeout plus the time to fetch the largest
+// allowed file at mirrorMinRate bytes per second.
+const (
+	mirrorBaseTimeout = 30 * time.Second
+	mirrorMinRate     = 128 << 10
+)
+
+// mirrorTimeout bounds one download of at most maxSize bytes.
+func mirrorTimeout(maxSize int64) time.Duration {
+	return mirrorBaseTimeout + time.Duration(maxSize/mirrorMinRate)*time.Second
+}
+
+// errNotDocument marks a URL that serves something other than a document.
+var errNotDocument = errors.New("not a document")
+
+// MirroredDoc is one mirrored document.
+type MirroredDoc struct {
+	URL         string
+	SHA256      string
+	Bucket      string
+	Key         string
+	Size        int64
+	ContentType string
+}
+
+// documentType returns the media type of a response and whether it is a
+// document, sniffing head when the server only says octet-stream.
+func documentType(header string, head []byte) (string, bool) {
+	mt, _, err := mime.ParseMediaType(header)
+	if err != nil || mt == "" || mt == "application/octet-stream" || mt == "binary/octet-stream" {
+		mt, _, _ = mime.ParseMediaType(http.DetectContentType(head))
+	}
+	_, ok := documentTypes[mt]
+	return mt, ok
+}
+
+// downloadDocument fetches target into a temporary file in dir if it is a
+// document no larger than maxSize bytes, returning the temp path, its
+// checksum, size and media type. The caller owns the temp file.
+func downloadDocument(ctx context.Context, client *http.Client, target, dir string, maxSize int64) (tmp, sum string, size int64, mediaType string, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return "", "", 0, "", err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", "", 0, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return "", "", 0, "", statusError("mirror", resp)
+	}
+
+	head := make([]byte, 512)
+	n, err := io.ReadFull(resp.Body, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", "", 0, "", err
+	}
+	head = head[:n]
+	mediaType, ok := documentType(resp.Header.Get("Content-Type"), head)
+	if !ok {
+		return "", "", 0, "", errNotDocument
+	}
+	if resp.ContentLength > maxSize {
+		return "", "", 0, "", fmt.Errorf("%d bytes is over the %d byte limit", resp.ContentLength, maxSize)
+	}
+
+	f, err := os.CreateTemp(dir, ".mirror-*")
+	if err != nil {
+		return "", "", 0, "", err
+	}
+	h := sha256.New()
+	size, err = io.Copy(io.MultiWriter(f, h), io.LimitReader(io.MultiReader(bytes.NewReader(head), resp.Body), maxSize+1))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), 0644)
+	}
+	if err == nil && size > maxSize {
+		err = fmt.Errorf("over the %d byte limit", maxSize)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", "", 0, "", err
+	}
+	return f.Name(), hex.EncodeToString(h.Sum(nil)), size, mediaType, nil
+}
+
+// mirrorStore writes documents under dir and catalogs them in storage.db.
+type mirrorStore struct {
+	dir      string
+	prefix   string // key of dir: its path relative to the working directory
+	bucket   string
+	bucketID int64
+	root     string // public URL the bucket is served at
+	storage  *sql.DB
+}
+
+// openMirrorStore opens storage.db and makes sure the bucket exists.
+func openMirrorStore(cfg config) (*mirrorStore, error) {
+	abs, err := filepath.Abs(cfg.MirrorDir)
+	if err != nil {
+		return nil, err
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		return nil, err
+	}
+	prefix, err := filepath.Rel(wd, abs)
+	if err != nil || prefix == "." || strings.HasPrefix(prefix, "..") {
+		return nil, fmt.Errorf("-mirrorDir %s must be inside the working directory for sync.sh to find it", cfg.MirrorDir)
+	}
+	if _, err := os.Stat(cfg.StorageDB); err != nil {
+		return nil, err
+	}
+	db, err := sql.Open("sqlite3", cfg.StorageDB)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(`INSERT OR IGNORE INTO buckets (name, created_at) VALUES (?, ?)`,
+		cfg.MirrorBucket, time.Now().UTC().Format(ledgerTimeLayout)); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("buckets: %w", err)
+	}
+	root, ok := bucketRoots[cfg.MirrorBucket]
+	if !ok {
+		root = "/doc"
+	}
+	m := &mirrorStore{
+		dir:     cfg.MirrorDir,
+		prefix:  filepath.ToSlash(prefix),
+		bucket:  cfg.MirrorBucket,
+		root:    strings.TrimRight(cfg.SiteURL, "/") + root,
+		storage: db,
+	}
+	if err := db.QueryRow(`SELECT id FROM buckets WHERE name = ?`, cfg.MirrorBucket).Scan(&m.bucketID); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("buckets: %w", err)
+	}
+	if err := os.MkdirAll(m.dir, 0755); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *mirrorStore) Close() error {
+	return m.storage.Close()
+}
+
+// Store moves a downloaded temp file to its content-addressed key, keeping
+// the copy already there if the same bytes were mirrored before, and
+// registers the object. original_url stays the first URL seen for it.
+func (m *mirrorStore) Store(url, tmp, sum string, size int64, mediaType string) (MirroredDoc, error) {
+	name := sum + documentTypes[mediaType]
+	key := m.prefix + "/" + name
+	path := filepath.Join(m.dir, name)
+	if _, err := os.Stat(path); err == nil {
+		os.Remove(tmp)
+	} else if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return MirroredDoc{}, err
+	}
+	_, err := m.storage.Exec(`
+		INSERT INTO objects (bucket_id, bucket_name, key, size, last_modified, original_url, public_url)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(bucket_name, key) DO UPDATE SET
+		  size = excluded.size,
+		  original_url = COALESCE(original_url, excluded.original_url),
+		  public_url = COALESCE(public_url, excluded.public_url)`,
+		m.bucketID, m.bucket, key, size, time.Now().UTC().Format(time.RFC3339), url, m.root+"/"+key)
+	if err != nil {
+		return MirroredDoc{}, fmt.Errorf("objects: %w", err)
+	}
+	return MirroredDoc{URL: url, SHA256: sum, Bucket: m.bucket, Key: key, Size: size, ContentType: mediaType}, nil
+}
+
+// mirrorDocuments mirrors each of urls that serves a document and is not
+// mirrored yet. It returns how many were stored, how many were documents
+// that could not be, and the URLs robots.txt kept it from fetching.
+func mirrorDocuments(ctx context.Context, cfg config, guard *fetchGuard, ledger *Ledger, urls []string) (stored, failed int, skipped []Skip) {
+	store, err := openMirrorStore(cfg)
+	if err != nil {
+		log.Printf("Mirroring disabled: %v", err)
+		return 0, 0, nil
+	}
+	defer store.Close()
+
+	var todo []string
+	for _, u := range urls {
+		doc, err := ledger.Mirrored(u)
+		if err != nil {
+			log.Printf("Ledger read error %s: %v", u, err)
+			continue
+		}
+		if doc == nil {
+			todo = append(todo, u)
+		}
+	}
+	sort.Strings(todo)
+
+	// Documents can be far larger than what the default client timeout is
+	// sized for, so each download gets a deadline scaled to -mirrorMaxMB.
+	client := *guard.client
+	client.Timeout = 0
+	maxSize := cfg.MirrorMaxMB << 20
+	timeout := mirrorTimeout(maxSize)
+	eg, egCtx := errgroup.WithContext(ctx)
+	eg.SetLimit(cfg.Concurrency)
+	var mu sync.Mutex
+	for _, u := range todo {
+		u := u
+		if egCtx.Err() != nil {
+			break
+		}
+		eg.Go(func() error {
+			if !guard.robots.Allowed(egCtx, u) {
+				mu.Lock()
+				skipped = append(skipped, Skip{URL: u, Stage: "mirror", Reason: "robots.txt"})
+				mu.Unlock()
+				return nil
+			}
+			if err := guard.hosts.Wait(egCtx, u); err != nil {
+				return nil
+			}
+			dlCtx, cancel := context.WithTimeout(egCtx, timeout)
+			tmp, sum, size, mediaType, err := downloadDocument(dlCtx, &client, u, store.dir, maxSize)
+			cancel()
+			if errors.Is(err, errNotDocument) || egCtx.Err() != nil {
+				return nil
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				log.Printf("Mirror %s: %v", u, err)
+				failed++
+				return nil
+			}
+			doc, err := store.Store(u, tmp, sum, size, mediaType)
+			if err == nil {
+				err = ledger.RecordMirror(doc, time.Now())
+			}
+			if err != nil {
+				log.Printf("Mirror write error %s: %v", u, err)
+				failed++
+				return nil
+			}
+			stored++
+			return nil
+		})
+	}
+	eg.Wait()
+	sortSkips(skipped)
+	return stored, failed, skipped
+}
+
+// runMirror is the "mirror" mode: it checks every cited URL and mirrors
+// the documents among them that are not mirrored yet.
+func runMirror(ctx context.Context, cfg config) {
+	if cfg.MirrorDir == "" {
+		log.Fatalf("-mirrorDir is empty, so there is nowhere to mirror documents")
+	}
+	set, err := gatherRefs(cfg)
+	if err != nil {
+		log.Fatalf("Failed to collect URLs: %v", err)
+	}
+	ledger, err := openLedger(cfg.LedgerPath)
+	if err != nil {
+		log.Fatalf("Failed to open ledger: %v", err)
+	}
+	defer ledger.Close()
+	stored, failed, skipped := mirrorDocuments(ctx, cfg, newFetchGuard(cfg), ledger, uniqueURLs(set.Refs))
+	writeSkipReport(cfg.ReportPath, set.Excluded, skipped)
+	fmt.Printf("Mirror complete: %d documents stored, %d failed, %d disallowed by robots.txt. Catalog: %s (bucket %s). Report: %s\n",
+		stored, failed, len(skipped), cfg.StorageDB, cfg.MirrorBucket, cfg.ReportPath)
+}
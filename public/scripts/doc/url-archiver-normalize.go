@@ -0,0 +1,352 @@
+// -----------------------------------------------------------------------------
+// File:          url-archiver-normalize.go
+// Description:   URL canonicalisation for URLArchiverV1 so trivially different
+//                spellings of one page are archived once. Lowercases scheme and
+//                host, drops default ports, tracking parameters and fragments,
+//                converts IDNs to punycode and applies per-domain rules.
+// Author:        Kris Yotam
+// License:       CC-0
+//
+// Rules file (JSON, -normalizeRules):
+//   {
+//     "default": { "forceHTTPS": false, "stripTrailingSlash": true },
+//     "domains": {
+//       "youtube.com": { "keepParams": ["v", "t", "list"] },
+//       "example.org": { "stripTrailingSlash": false, "keepFragment": true }
+//     }
+//   }
+// A domain rule applies to the domain and all its subdomains and overrides
+// only the fields it sets. Without forceHTTPS an http:// URL is still folded
+// into its https:// twin when both spellings are cited.
+// -----------------------------------------------------------------------------
+
+package main
+
+import (
+	"encoding/json"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// normalizeRule controls how URLs on one domain are canonicalised. Nil fields
+// inherit from the default rule.
+type normalizeRule struct {
+	ForceHTTPS         *bool    `json:"forceHTTPS,omitempty"`
+	StripTrailingSlash *bool    `json:"stripTrailingSlash,omitempty"`
+	StripWWW           *bool    `json:"stripWWW,omitempty"`
+	KeepFragment       *bool    `json:"keepFragment,omitempty"`
+	StripParams        []string `json:"stripParams,omitempty"` // extra params to drop; "prefix_*" globs allowed
+	KeepParams         []string `json:"keepParams,omitempty"`  // if set, drop every param not listed
+}
+
+type normalizeRules struct {
+	Default normalizeRule            `json:"default"`
+	Domains map[string]normalizeRule `json:"domains"`
+}
+
+// trackingParams are dropped everywhere; entries ending in * match a prefix.
+var trackingParams = []string{
+	"utm_*", "fbclid", "gclid", "dclid", "gbraid", "wbraid", "msclkid", "mc_cid", "mc_eid",
+	"_hsenc", "_hsmi", "hsCtaTracking", "igshid", "mkt_tok", "oly_anon_id", "oly_enc_id",
+	"rb_clickid", "s_cid", "vero_conv", "vero_id", "yclid", "ref_src", "ref_url", "__s",
+}
+
+func boolPtr(b bool) *bool { return &b }
+
+// defaultNormalizeRules is used when no rules file is given.
+func defaultNormalizeRules() normalizeRules {
+	return normalizeRules{
+		Default: normalizeRule{
+			ForceHTTPS:         boolPtr(false),
+			StripTrailingSlash: boolPtr(true),
+			StripWWW:           boolPtr(false),
+			KeepFragment:       boolPtr(false),
+		},
+	}
+}
+
+// loadNormalizeRules reads a rules file, layering it over the defaults. An
+// empty path returns the defaults.
+func loadNormalizeRules(path string) (normalizeRules, error) {
+	rules := defaultNormalizeRules()
+	if path == "" {
+		return rules, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return rules, err
+	}
+	var file normalizeRules
+	if err := json.Unmarshal(data, &file); err != nil {
+		return rules, err
+	}
+	rules.Default = mergeRule(rules.Default, file.Default)
+	rules.Domains = make(map[string]normalizeRule, len(file.Domains))
+	for d, r := range file.Domains {
+		rules.Domains[strings.ToLower(d)] = r
+	}
+	return rules, nil
+}
+
+// mergeRule returns base with every field set in over applied on top.
+func mergeRule(base, over normalizeRule) normalizeRule {
+	if over.ForceHTTPS != nil {
+		base.ForceHTTPS = over.ForceHTTPS
+	}
+	if over.StripTrailingSlash != nil {
+		base.StripTrailingSlash = over.StripTrailingSlash
+	}
+	if over.StripWWW != nil {
+		base.StripWWW = over.StripWWW
+	}
+	if over.KeepFragment != nil {
+		base.KeepFragment = over.KeepFragment
+	}
+	base.StripParams = append(append([]string(nil), base.StripParams...), over.StripParams...)
+	if over.KeepParams != nil {
+		base.KeepParams = over.KeepParams
+	}
+	return base
+}
+
+// ruleFor resolves the effective rule for host, with the most specific
+// matching domain winning.
+func (r normalizeRules) ruleFor(host string) normalizeRule {
+	rule := r.Default
+	var matches []string
+	for d := range r.Domains {
+		if host == d || strings.HasSuffix(host, "."+d) {
+			matches = append(matches, d)
+		}
+	}
+	// Apply shorter (broader) domains first so subdomain rules override them.
+	sort.Slice(matches, func(i, j int) bool { return len(matches[i]) < len(matches[j]) })
+	for _, d := range matches {
+		rule = mergeRule(rule, r.Domains[d])
+	}
+	return rule
+}
+
+// normalizeURL returns the canonical form of raw, or raw unchanged if it
+// does not parse as an absolute http(s) URL.
+func (r normalizeRules) normalizeURL(raw string) string {
+	u, err := url.Parse(strings.TrimSpace(raw))
+	if err != nil || u.Host == "" {
+		return raw
+	}
+	u.Scheme = strings.ToLower(u.Scheme)
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return raw
+	}
+
+	host := strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+	port := u.Port()
+	host = toASCIIHost(host)
+	rule := r.ruleFor(host)
+
+	if *rule.StripWWW {
+		host = strings.TrimPrefix(host, "www.")
+	}
+	if *rule.ForceHTTPS && u.Scheme == "http" {
+		u.Scheme = "https"
+		if port == "80" {
+			port = ""
+		}
+	}
+	if (u.Scheme == "http" && port == "80") || (u.Scheme == "https" && port == "443") {
+		port = ""
+	}
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]" // IPv6 literal
+	}
+	if port != "" {
+		host += ":" + port
+	}
+	u.Host = host
+	u.User = nil
+
+	// Clean dot segments but leave the trailing slash decision to the rule.
+	// Paths with non-default escaping (RawPath set) are left alone so an
+	// encoded %2F never turns into a real separator.
+	if u.Path != "" && u.RawPath == "" {
+		cleaned := path.Clean(u.Path)
+		if strings.HasSuffix(u.Path, "/") && cleaned != "/" {
+			cleaned += "/"
+		}
+		u.Path = cleaned
+	}
+	if *rule.StripTrailingSlash && len(u.Path) > 1 {
+		u.Path = strings.TrimRight(u.Path, "/")
+		u.RawPath = strings.TrimRight(u.RawPath, "/")
+	}
+	if u.Path == "" {
+		u.Path = "/"
+	}
+
+	if u.RawQuery != "" {
+		u.RawQuery = filterQuery(u.RawQuery, rule)
+	}
+	u.ForceQuery = false
+	if !*rule.KeepFragment {
+		u.Fragment = ""
+		u.RawFragment = ""
+	}
+	return u.String()
+}
+
+// filterQuery drops tracking and rule-excluded parameters while keeping the
+// original order of the rest.
+func filterQuery(rawQuery string, rule normalizeRule) string {
+	var kept []string
+	for _, pair := range strings.Split(rawQuery, "&") {
+		if pair == "" {
+			continue
+		}
+		key := pair
+		if i := strings.IndexByte(pair, '='); i >= 0 {
+			key = pair[:i]
+		}
+		if k, err := url.QueryUnescape(key); err == nil {
+			key = k
+		}
+		if rule.KeepParams != nil {
+			if !matchParam(key, rule.KeepParams) {
+				continue
+			}
+		} else if matchParam(key, trackingParams) || matchParam(key, rule.StripParams) {
+			continue
+		}
+		kept = append(kept, pair)
+	}
+	return strings.Join(kept, "&")
+}
+
+func matchParam(key string, patterns []string) bool {
+	for _, p := range patterns {
+		if prefix, ok := strings.CutSuffix(p, "*"); ok {
+			if strings.HasPrefix(key, prefix) {
+				return true
+			}
+		} else if strings.EqualFold(key, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// -----------------------------------------------------------------------------
+// IDN (RFC 3492 punycode)
+// -----------------------------------------------------------------------------
+
+// toASCIIHost converts each non-ASCII label of host to its xn-- form.
+func toASCIIHost(host string) string {
+	labels := strings.Split(host, ".")
+	for i, l := range labels {
+		if !isASCII(l) {
+			labels[i] = "xn--" + punycodeEncode(l)
+		}
+	}
+	return strings.Join(labels, ".")
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+const (
+	pcBase        = 36
+	pcTMin        = 1
+	pcTMax        = 26
+	pcSkew        = 38
+	pcDamp        = 700
+	pcInitialBias = 72
+	pcInitialN    = 128
+)
+
+// punycodeEncode implements the encoding procedure of RFC 3492 section 6.3.
+func punycodeEncode(label string) string {
+	runes := []rune(label)
+	var out strings.Builder
+	basic := 0
+	for _, r := range runes {
+		if r < 0x80 {
+			out.WriteRune(r)
+			basic++
+		}
+	}
+	handled := basic
+	if basic > 0 {
+		out.WriteByte('-')
+	}
+	n, delta, bias := rune(pcInitialN), 0, pcInitialBias
+	for handled < len(runes) {
+		m := rune(0x7fffffff)
+		for _, r := range runes {
+			if r >= n && r < m {
+				m = r
+			}
+		}
+		delta += int(m-n) * (handled + 1)
+		n = m
+		for _, r := range runes {
+			if r < n {
+				delta++
+			}
+			if r != n {
+				continue
+			}
+			q := delta
+			for k := pcBase; ; k += pcBase {
+				t := k - bias
+				if t < pcTMin {
+					t = pcTMin
+				} else if t > pcTMax {
+					t = pcTMax
+				}
+				if q < t {
+					break
+				}
+				out.WriteByte(punycodeDigit(t + (q-t)%(pcBase-t)))
+				q = (q - t) / (pcBase - t)
+			}
+			out.WriteByte(punycodeDigit(q))
+			bias = punycodeAdapt(delta, handled+1, handled == basic)
+			delta = 0
+			handled++
+		}
+		delta++
+		n++
+	}
+	return out.String()
+}
+
+func punycodeDigit(d int) byte {
+	if d < 26 {
+		return byte('a' + d)
+	}
+	return byte('0' + d - 26)
+}
+
+func punycodeAdapt(delta, numPoints int, first bool) int {
+	if first {
+		delta /= pcDamp
+	} else {
+		delta /= 2
+	}
+	delta += delta / numPoints
+	k := 0
+	for delta > ((pcBase-pcTMin)*pcTMax)/2 {
+		delta /= pcBase - pcTMin
+		k += pcBase
+	}
+	return k + (pcBase-pcTMin+1)*delta/(delta+pcSkew)
+}
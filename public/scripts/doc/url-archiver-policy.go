@@ -0,0 +1,266 @@
+// -----------------------------------------------------------------------------
+// File:          url-archiver-policy.go
+// Description:   Domain allow/deny policy for URLArchiverV1. Decides which
+//                cited URLs may be submitted at all (never localhost, our own
+//                pages or tokenised private documents) and which must be
+//                archived on every run regardless of -maxAge.
+// Author:        Kris Yotam
+// License:       CC-0
+//
+// Policy file (JSON, -policy):
+//   {
+//     "default": "allow",
+//     "rules": [
+//       { "action": "deny", "domain": "krisyotam.com", "reason": "our own site" },
+//       { "action": "deny", "domain": "drive.google.com", "reason": "private drive" },
+//       { "action": "deny", "domain": "docs.google.com", "regex": "[?&](resourcekey|usp)=", "reason": "tokenised Google Doc" },
+//       { "action": "always", "domain": "*.gov", "path": "/press/*" }
+//     ]
+//   }
+// Rules are tried in order and the first match wins. A rule matches when all
+// of its set fields do: "domain" is a glob on the host (a bare domain also
+// covers its subdomains), "path" a glob on the path, "regex" a Go regexp on
+// the whole URL. In globs * matches any run of characters, / included.
+// Actions are allow, deny and always (allow, and resubmit every run).
+// Loopback, private and .local/.internal hosts, and links to -siteURL, are
+// denied after the rules unless a rule allowed them first.
+// -----------------------------------------------------------------------------
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Policy actions.
+const (
+	policyAllow  = "allow"
+	policyDeny   = "deny"
+	policyAlways = "always"
+)
+
+// policyRule is one entry of the policy file.
+type policyRule struct {
+	Action string `json:"action"`
+	Domain string `json:"domain,omitempty"`
+	Path   string `json:"path,omitempty"`
+	Regex  string `json:"regex,omitempty"`
+	Reason string `json:"reason,omitempty"`
+
+	domainRe *regexp.Regexp
+	pathRe   *regexp.Regexp
+	urlRe    *regexp.Regexp
+}
+
+// urlPolicy is a loaded policy file.
+type urlPolicy struct {
+	Default string       `json:"default"`
+	Rules   []policyRule `json:"rules"`
+}
+
+// Exclusion is a cited URL the policy refused, with the rule that did it.
+type Exclusion struct {
+	URL     string
+	Reason  string
+	Sources []URLRef
+}
+
+// loadPolicy reads and compiles a policy file. An empty path gives the
+// default policy: allow everything except local and private hosts.
+func loadPolicy(path string) (*urlPolicy, error) {
+	p := &urlPolicy{Default: policyAllow}
+	if path == "" {
+		return p, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, p); err != nil {
+		return nil, err
+	}
+	if p.Default == "" {
+		p.Default = policyAllow
+	}
+	if !validAction(p.Default) {
+		return nil, fmt.Errorf("default: unknown action %q", p.Default)
+	}
+	for i := range p.Rules {
+		r := &p.Rules[i]
+		if !validAction(r.Action) {
+			return nil, fmt.Errorf("rule %d: unknown action %q (want allow, deny or always)", i+1, r.Action)
+		}
+		if err := r.compile(); err != nil {
+			return nil, fmt.Errorf("rule %d: %w", i+1, err)
+		}
+	}
+	return p, nil
+}
+
+// compile builds the rule's matchers from its domain, path and regex.
+func (r *policyRule) compile() error {
+	if r.Domain == "" && r.Path == "" && r.Regex == "" {
+		return fmt.Errorf("needs a domain, path or regex")
+	}
+	if r.Domain != "" {
+		d := strings.ToLower(r.Domain)
+		expr := globToRegex(d)
+		if !strings.ContainsAny(d, "*?") {
+			expr = `(?:.*\.)?` + expr
+		}
+		r.domainRe = regexp.MustCompile("^" + expr + "$")
+	}
+	if r.Path != "" {
+		r.pathRe = regexp.MustCompile("^" + globToRegex(r.Path) + "$")
+	}
+	if r.Regex != "" {
+		var err error
+		if r.urlRe, err = regexp.Compile(r.Regex); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// denyOwnSite adds a last rule refusing links to our own site, which the
+// links mode validates instead. Rules in the file still come first, so one
+// can allow the site back in.
+func (p *urlPolicy) denyOwnSite(host string) {
+	if host == "" {
+		return
+	}
+	r := policyRule{Action: policyDeny, Domain: host, Reason: "internal link (checked by links mode)"}
+	if r.compile() == nil {
+		p.Rules = append(p.Rules, r)
+	}
+}
+
+func validAction(a string) bool {
+	return a == policyAllow || a == policyDeny || a == policyAlways
+}
+
+// globToRegex turns a glob where * and ? match any characters into an
+// unanchored regexp body.
+func globToRegex(glob string) string {
+	var b strings.Builder
+	for _, c := range glob {
+		switch c {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return b.String()
+}
+
+// describe names a rule for reports when it has no reason of its own.
+func (r *policyRule) describe() string {
+	if r.Reason != "" {
+		return r.Reason
+	}
+	var parts []string
+	if r.Domain != "" {
+		parts = append(parts, "domain="+r.Domain)
+	}
+	if r.Path != "" {
+		parts = append(parts, "path="+r.Path)
+	}
+	if r.Regex != "" {
+		parts = append(parts, "regex="+r.Regex)
+	}
+	return r.Action + " " + strings.Join(parts, " ")
+}
+
+func (r *policyRule) matches(u *url.URL, host, raw string) bool {
+	if r.domainRe != nil && !r.domainRe.MatchString(host) {
+		return false
+	}
+	if r.pathRe != nil && !r.pathRe.MatchString(u.EscapedPath()) {
+		return false
+	}
+	if r.urlRe != nil && !r.urlRe.MatchString(raw) {
+		return false
+	}
+	return true
+}
+
+// Decide returns the action for raw and, for denials, why.
+func (p *urlPolicy) Decide(raw string) (action, reason string) {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return policyDeny, "unparseable URL"
+	}
+	host := strings.ToLower(u.Hostname())
+	for i := range p.Rules {
+		r := &p.Rules[i]
+		if r.matches(u, host, raw) {
+			return r.Action, r.describe()
+		}
+	}
+	if isLocalHost(host) {
+		return policyDeny, "private or local address"
+	}
+	if p.Default == policyDeny {
+		return policyDeny, "not allowed by any rule"
+	}
+	return p.Default, ""
+}
+
+// isLocalHost reports hosts no public archive can reach.
+func isLocalHost(host string) bool {
+	host = strings.TrimSuffix(host, ".")
+	if host == "localhost" {
+		return true
+	}
+	for _, suffix := range []string{".localhost", ".local", ".internal", ".lan", ".home.arpa"} {
+		if strings.HasSuffix(host, suffix) {
+			return true
+		}
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsUnspecified()
+	}
+	return false
+}
+
+// applyPolicy splits refs into those the policy lets through and the
+// exclusions, and lists the URLs to archive on every run.
+func applyPolicy(refs []URLRef, p *urlPolicy) (kept []URLRef, excluded []Exclusion, always map[string]bool) {
+	always = make(map[string]bool)
+	byURL := make(map[string]*Exclusion)
+	decided := make(map[string]string)
+	for _, r := range refs {
+		action, ok := decided[r.URL]
+		if !ok {
+			var reason string
+			action, reason = p.Decide(r.URL)
+			decided[r.URL] = action
+			if action == policyDeny {
+				byURL[r.URL] = &Exclusion{URL: r.URL, Reason: reason}
+			}
+			if action == policyAlways {
+				always[r.URL] = true
+			}
+		}
+		if action == policyDeny {
+			byURL[r.URL].Sources = append(byURL[r.URL].Sources, r)
+			continue
+		}
+		kept = append(kept, r)
+	}
+	for _, e := range byURL {
+		excluded = append(excluded, *e)
+	}
+	sort.Slice(excluded, func(i, j int) bool { return excluded[i].URL < excluded[j].URL })
+	return kept, excluded, always
+}
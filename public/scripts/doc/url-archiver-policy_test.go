@@ -0,0 +1,145 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func writePolicy(t *testing.T, body string) *urlPolicy {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "policy.json")
+	if err := os.WriteFile(path, []byte(body), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	p, err := loadPolicy(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestPolicyDecide(t *testing.T) {
+	p := writePolicy(t, `{
+		"rules": [
+			{"action": "allow", "domain": "public.drive.google.com"},
+			{"action": "deny", "domain": "drive.google.com", "reason": "private drive"},
+			{"action": "deny", "domain": "docs.google.com", "regex": "[?&](resourcekey|usp)="},
+			{"action": "always", "domain": "*.gov", "path": "/press/*"},
+			{"action": "deny", "path": "*.zip"},
+			{"action": "allow", "domain": "localhost", "path": "/public/*"}
+		]
+	}`)
+	cases := []struct{ url, action, reason string }{
+		// The first matching rule wins, so the narrower allow beats the deny.
+		{"https://public.drive.google.com/file/1", policyAllow, "allow domain=public.drive.google.com"},
+		{"https://drive.google.com/file/1", policyDeny, "private drive"},
+		// A bare domain covers its subdomains but not lookalikes.
+		{"https://www.drive.google.com/file/1", policyDeny, "private drive"},
+		{"https://notdrive.google.com/file/1", policyAllow, ""},
+		// Every set field must match.
+		{"https://docs.google.com/document/d/1?usp=sharing", policyDeny, "deny domain=docs.google.com regex=[?&](resourcekey|usp)="},
+		{"https://docs.google.com/document/d/1", policyAllow, ""},
+		{"https://www.whitehouse.gov/press/2024/statement", policyAlways, "always domain=*.gov path=/press/*"},
+		{"https://www.whitehouse.gov/about", policyAllow, ""},
+		{"https://gov/press/x", policyAllow, ""},
+		{"https://example.com/files/data.zip", policyDeny, "deny path=*.zip"},
+		// Local hosts are refused after the rules, so a rule can let one in.
+		{"http://localhost:3000/public/a", policyAllow, "allow domain=localhost path=/public/*"},
+		{"http://localhost:3000/admin", policyDeny, "private or local address"},
+		{"http://192.168.1.10/x", policyDeny, "private or local address"},
+		{"http://printer.local/x", policyDeny, "private or local address"},
+		{"http://[::1]/x", policyDeny, "private or local address"},
+		{"/essays/one", policyDeny, "unparseable URL"},
+	}
+	for _, c := range cases {
+		action, reason := p.Decide(c.url)
+		if action != c.action || reason != c.reason {
+			t.Errorf("Decide(%q) = %s %q, want %s %q", c.url, action, reason, c.action, c.reason)
+		}
+	}
+}
+
+func TestPolicyDefaultDeny(t *testing.T) {
+	p := writePolicy(t, `{"default": "deny", "rules": [{"action": "allow", "domain": "example.com"}]}`)
+	if action, _ := p.Decide("https://sub.example.com/a"); action != policyAllow {
+		t.Errorf("example.com subdomain = %s, want allow", action)
+	}
+	if action, reason := p.Decide("https://other.example/a"); action != policyDeny || reason != "not allowed by any rule" {
+		t.Errorf("other.example = %s %q, want deny by default", action, reason)
+	}
+}
+
+func TestPolicyDenyOwnSite(t *testing.T) {
+	p, err := loadPolicy("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.denyOwnSite("krisyotam.com")
+	if action, reason := p.Decide("https://www.krisyotam.com/essays/one"); action != policyDeny || reason != "internal link (checked by links mode)" {
+		t.Errorf("own site = %s %q, want denied as an internal link", action, reason)
+	}
+	if action, _ := p.Decide("https://example.com/"); action != policyAllow {
+		t.Errorf("other site = %s, want allow", action)
+	}
+
+	// A rule in the file comes first and can let part of the site back in.
+	p = writePolicy(t, `{"rules": [{"action": "always", "domain": "krisyotam.com", "path": "/papers/*"}]}`)
+	p.denyOwnSite("krisyotam.com")
+	if action, _ := p.Decide("https://krisyotam.com/papers/a.pdf"); action != policyAlways {
+		t.Errorf("allowed-back page = %s, want always", action)
+	}
+	if action, _ := p.Decide("https://krisyotam.com/essays/one"); action != policyDeny {
+		t.Errorf("other own page = %s, want deny", action)
+	}
+}
+
+func TestLoadPolicyErrors(t *testing.T) {
+	for name, body := range map[string]string{
+		"unknown default": `{"default": "maybe"}`,
+		"unknown action":  `{"rules": [{"action": "skip", "domain": "example.com"}]}`,
+		"no matcher":      `{"rules": [{"action": "deny", "reason": "everything"}]}`,
+		"bad regex":       `{"rules": [{"action": "deny", "regex": "("}]}`,
+		"bad JSON":        `{"rules": [`,
+	} {
+		path := filepath.Join(t.TempDir(), "policy.json")
+		if err := os.WriteFile(path, []byte(body), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadPolicy(path); err == nil {
+			t.Errorf("%s: loaded without error", name)
+		}
+	}
+}
+
+func TestApplyPolicy(t *testing.T) {
+	p := writePolicy(t, `{"rules": [
+		{"action": "deny", "domain": "drive.google.com", "reason": "private drive"},
+		{"action": "always", "domain": "news.example"}
+	]}`)
+	refs := []URLRef{
+		{URL: "https://drive.google.com/b", File: "one.md", Line: 1},
+		{URL: "https://example.com/a", File: "one.md", Line: 2},
+		{URL: "https://drive.google.com/b", File: "two.md", Line: 5},
+		{URL: "http://localhost/a", File: "two.md", Line: 6},
+		{URL: "https://news.example/today", File: "two.md", Line: 7},
+	}
+	kept, excluded, always := applyPolicy(refs, p)
+
+	wantKept := []URLRef{refs[1], refs[4]}
+	if !reflect.DeepEqual(kept, wantKept) {
+		t.Errorf("kept = %+v, want %+v", kept, wantKept)
+	}
+	// Exclusions are sorted by URL and carry every source that cited them.
+	wantExcluded := []Exclusion{
+		{URL: "http://localhost/a", Reason: "private or local address", Sources: []URLRef{refs[3]}},
+		{URL: "https://drive.google.com/b", Reason: "private drive", Sources: []URLRef{refs[0], refs[2]}},
+	}
+	if !reflect.DeepEqual(excluded, wantExcluded) {
+		t.Errorf("excluded = %+v, want %+v", excluded, wantExcluded)
+	}
+	if !reflect.DeepEqual(always, map[string]bool{"https://news.example/today": true}) {
+		t.Errorf("always = %v", always)
+	}
+}
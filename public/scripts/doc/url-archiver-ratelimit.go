@@ -0,0 +1,368 @@
+// -----------------------------------------------------------------------------
+// File:          url-archiver-ratelimit.go
+// Description:   Retry with backoff, token-bucket rate limiting and circuit
+//                breaking around archival backends for URLArchiverV1
+// Author:        Kris Yotam
+// License:       CC-0
+// -----------------------------------------------------------------------------
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// errCircuitOpen marks results skipped because their service's breaker was open.
+var errCircuitOpen = errors.New("circuit open: service paused after repeated failures")
+
+// httpStatusError is returned by backends for non-success responses so the
+// retry loop can tell throttling and server errors from permanent failures.
+type httpStatusError struct {
+	Prefix     string
+	Status     int
+	RetryAfter time.Duration
+}
+
+func (e *httpStatusError) Error() string {
+	return fmt.Sprintf("%s: unexpected status %d", e.Prefix, e.Status)
+}
+
+// statusError builds an httpStatusError from resp, reading Retry-After.
+func statusError(prefix string, resp *http.Response) error {
+	return &httpStatusError{
+		Prefix:     prefix,
+		Status:     resp.StatusCode,
+		RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()),
+	}
+}
+
+// parseRetryAfter accepts both delta-seconds and HTTP-date forms.
+func parseRetryAfter(v string, now time.Time) time.Duration {
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(v); err == nil && secs > 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+	return 0
+}
+
+// retryable reports whether err is worth another attempt: throttling, server
+// errors and transport failures are; other 4xx responses, cancellation and
+// a submission that was accepted but left no snapshot are not.
+func retryable(err error) bool {
+	switch {
+	case err == nil, errors.Is(err, context.Canceled), errors.Is(err, errCircuitOpen),
+		errors.Is(err, errRobotsDisallowed), errors.Is(err, errNoSnapshot):
+		return false
+	}
+	var se *httpStatusError
+	if errors.As(err, &se) {
+		return se.Status == http.StatusTooManyRequests || se.Status >= 500
+	}
+	return true
+}
+
+// -----------------------------------------------------------------------------
+// Token bucket
+// -----------------------------------------------------------------------------
+
+// tokenBucket allows rate events per second with bursts up to burst.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// Wait blocks until a token is available or ctx is done. A non-positive rate
+// disables limiting.
+func (b *tokenBucket) Wait(ctx context.Context) error {
+	if b == nil {
+		return nil
+	}
+	for {
+		// rate is read under the lock since SetDelay may change it.
+		b.mu.Lock()
+		if b.rate <= 0 {
+			b.mu.Unlock()
+			return nil
+		}
+		now := time.Now()
+		b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+		b.last = now
+		if b.tokens >= 1 {
+			b.tokens--
+			b.mu.Unlock()
+			return nil
+		}
+		wait := time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+		b.mu.Unlock()
+		if err := sleepCtx(ctx, wait); err != nil {
+			return err
+		}
+	}
+}
+
+// hostLimiter hands out one token bucket per target host, shared by every
+// service so a single origin is never hit harder than -hostRate.
+type hostLimiter struct {
+	mu      sync.Mutex
+	rate    float64
+	buckets map[string]*tokenBucket
+}
+
+func newHostLimiter(rate float64) *hostLimiter {
+	return &hostLimiter{rate: rate, buckets: make(map[string]*tokenBucket)}
+}
+
+func (h *hostLimiter) Wait(ctx context.Context, target string) error {
+	if h == nil {
+		return nil
+	}
+	host := target
+	if u, err := url.Parse(target); err == nil && u.Host != "" {
+		host = u.Hostname()
+	}
+	return h.bucket(host).Wait(ctx)
+}
+
+func (h *hostLimiter) bucket(host string) *tokenBucket {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	b, ok := h.buckets[host]
+	if !ok {
+		b = newTokenBucket(h.rate, 1)
+		h.buckets[host] = b
+	}
+	return b
+}
+
+// SetDelay slows host down to one request per d, as its robots.txt
+// Crawl-delay asks. It never speeds a host up.
+func (h *hostLimiter) SetDelay(host string, d time.Duration) {
+	b := h.bucket(host)
+	rate := 1 / d.Seconds()
+	b.mu.Lock()
+	if b.rate <= 0 || rate < b.rate {
+		b.rate = rate
+	}
+	b.mu.Unlock()
+}
+
+// -----------------------------------------------------------------------------
+// Circuit breaker
+// -----------------------------------------------------------------------------
+
+// circuitBreaker opens after threshold consecutive failed URLs and rejects calls
+// until cooldown has passed, then lets a single trial call through.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	openUntil time.Time
+	trial     bool
+	trips     int
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{threshold: threshold, cooldown: cooldown}
+}
+
+// Allow reports whether a call may proceed.
+func (c *circuitBreaker) Allow(now time.Time) bool {
+	if c.threshold <= 0 {
+		return true
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.openUntil.IsZero() {
+		return true
+	}
+	if now.Before(c.openUntil) || c.trial {
+		return false
+	}
+	c.trial = true
+	return true
+}
+
+// Report records the outcome of an allowed call.
+func (c *circuitBreaker) Report(ok bool, now time.Time) {
+	if c.threshold <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if ok {
+		c.failures = 0
+		c.openUntil = time.Time{}
+		c.trial = false
+		return
+	}
+	c.failures++
+	if c.trial || c.failures >= c.threshold {
+		c.openUntil = now.Add(c.cooldown)
+		c.trial = false
+		c.trips++
+	}
+}
+
+// Abandon releases a half-open trial whose call was cancelled without an
+// outcome, so the next call can try again.
+func (c *circuitBreaker) Abandon() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.trial = false
+}
+
+// Open reports whether the breaker is rejecting calls at now, either
+// cooling down or waiting on its half-open trial.
+func (c *circuitBreaker) Open(now time.Time) bool {
+	if c.threshold <= 0 {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return !c.openUntil.IsZero() && (now.Before(c.openUntil) || c.trial)
+}
+
+// PausedUntil returns when an open breaker will next let a call through,
+// or the zero time when it is closed.
+func (c *circuitBreaker) PausedUntil() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.openUntil
+}
+
+// Trips returns how many times the breaker has opened.
+func (c *circuitBreaker) Trips() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.trips
+}
+
+// -----------------------------------------------------------------------------
+// Guarded archiver
+// -----------------------------------------------------------------------------
+
+// retryPolicy controls exponential backoff with full jitter.
+type retryPolicy struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+}
+
+// delay returns how long to wait before attempt n+1 (n counts from 1),
+// preferring the server's Retry-After when it sent one.
+func (p retryPolicy) delay(n int, err error) time.Duration {
+	var se *httpStatusError
+	if errors.As(err, &se) && se.RetryAfter > 0 {
+		return min(se.RetryAfter, p.MaxDelay)
+	}
+	backoff := p.BaseDelay << (n - 1)
+	if backoff <= 0 || backoff > p.MaxDelay {
+		backoff = p.MaxDelay
+	}
+	return time.Duration(rand.Int63n(int64(backoff) + 1))
+}
+
+// guardedArchiver wraps a backend with per-service and per-host rate limits,
+// retries and a circuit breaker.
+type guardedArchiver struct {
+	Archiver
+	service *tokenBucket
+	hosts   *hostLimiter
+	breaker *circuitBreaker
+	retry   retryPolicy
+}
+
+func (g *guardedArchiver) Archive(ctx context.Context, target string) ArchiveResult {
+	if !g.breaker.Allow(time.Now()) {
+		return ArchiveResult{URL: target, Service: g.Name(), Error: errCircuitOpen}
+	}
+	res := g.attempt(ctx, target)
+	// Only service-side trouble counts against the breaker: a URL the service
+	// rejects outright says nothing about whether the service is healthy.
+	if ctx.Err() != nil {
+		g.breaker.Abandon()
+	} else {
+		g.breaker.Report(res.Error == nil || !retryable(res.Error), time.Now())
+	}
+	return res
+}
+
+// attempt runs the retry loop for one URL, waiting on both rate limits
+// before every try. Duration covers the requests themselves, not the waits.
+func (g *guardedArchiver) attempt(ctx context.Context, target string) ArchiveResult {
+	var res ArchiveResult
+	var spent time.Duration
+	for attempt := 1; ; attempt++ {
+		err := g.service.Wait(ctx)
+		if err == nil {
+			err = g.hosts.Wait(ctx, target)
+		}
+		if err != nil {
+			// Keep the last real failure rather than masking it with the
+			// reason we stopped retrying.
+			if attempt > 1 {
+				return res
+			}
+			return ArchiveResult{URL: target, Service: g.Name(), Error: err}
+		}
+		start := time.Now()
+		res = g.Archiver.Archive(ctx, target)
+		spent += time.Since(start)
+		res.Attempts = attempt
+		res.Duration = spent
+		if res.Error == nil || !retryable(res.Error) || attempt >= g.retry.MaxAttempts {
+			return res
+		}
+		if err := sleepCtx(ctx, g.retry.delay(attempt, res.Error)); err != nil {
+			return res
+		}
+	}
+}
+
+// Close forwards to the wrapped backend so warc files still get closed.
+func (g *guardedArchiver) Close() error {
+	if c, ok := g.Archiver.(interface{ Close() error }); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// sleepCtx waits for d or until ctx is done.
+func sleepCtx(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
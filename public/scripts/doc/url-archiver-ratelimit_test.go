@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHostLimiterSetDelay(t *testing.T) {
+	const delay = 50 * time.Millisecond
+	const target = "https://example.com/essay"
+	hosts := newHostLimiter(0)
+	ctx := context.Background()
+	// Waits already in flight while the delay arrives must not race with it.
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			hosts.Wait(ctx, target)
+		}()
+	}
+	hosts.SetDelay("example.com", delay)
+	wg.Wait()
+
+	// Once the bucket has refilled, one request goes straight through and
+	// the next waits out the delay.
+	time.Sleep(delay)
+	hosts.Wait(ctx, target)
+	start := time.Now()
+	hosts.Wait(ctx, target)
+	if got := time.Since(start); got < delay*9/10 {
+		t.Errorf("second request waited %v, want about %v", got, delay)
+	}
+	// Other hosts are unaffected.
+	start = time.Now()
+	hosts.Wait(ctx, "https://other.example/")
+	if got := time.Since(start); got > delay/2 {
+		t.Errorf("another host waited %v", got)
+	}
+}
@@ -0,0 +1,548 @@
+// -----------------------------------------------------------------------------
+// File:          url-archiver-report.go
+// Description:   Run reports for URLArchiverV1's archive mode. The text report
+//                is for reading; JSON, JSONL, CSV and an HTML dashboard carry
+//                one row per source occurrence and service, sorted so two runs
+//                can be diffed and the site build can consume the results.
+// Author:        Kris Yotam
+// License:       CC-0
+// -----------------------------------------------------------------------------
+
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Report formats accepted by -format.
+const (
+	formatText  = "text"
+	formatJSON  = "json"
+	formatJSONL = "jsonl"
+	formatCSV   = "csv"
+	formatHTML  = "html"
+)
+
+// runReport is everything writeReport needs to describe one run.
+type runReport struct {
+	Results  []ArchiveResult
+	Sources  map[string][]URLRef
+	Excluded []Exclusion
+	Skipped  []Skip // fetches the text and mirror stages did not make
+	Breakers map[string]*circuitBreaker
+	Left     int
+}
+
+// Skip is a URL a fetching stage left alone, and why.
+type Skip struct {
+	URL    string
+	Stage  string // "text" or "mirror"
+	Reason string
+}
+
+// sortSkips orders skips by URL, then stage.
+func sortSkips(skips []Skip) {
+	sort.Slice(skips, func(i, j int) bool {
+		if skips[i].URL != skips[j].URL {
+			return skips[i].URL < skips[j].URL
+		}
+		return skips[i].Stage < skips[j].Stage
+	})
+}
+
+// ReportRow is one URL occurrence in one source file as submitted to one
+// service. URLs with no known source (resumed runs) have an empty File, and
+// URLs the policy refused have no Service and say why in ExcludedBecause;
+// fetches robots.txt ruled out keep their Service (or stage, for text
+// snapshots and mirroring) and give "robots.txt".
+type ReportRow struct {
+	File            string `json:"file"`
+	Line            int    `json:"line,omitempty"`
+	Type            string `json:"type,omitempty"`
+	Slug            string `json:"slug,omitempty"`
+	Kind            string `json:"kind,omitempty"`
+	Citation        string `json:"citation,omitempty"`
+	URL             string `json:"url"`
+	Service         string `json:"service"`
+	Archived        bool   `json:"archived"`
+	SnapshotURL     string `json:"snapshot_url,omitempty"`
+	SnapshotAt      string `json:"snapshot_at,omitempty"` // memento timestamp, RFC 3339
+	HTTPStatus      int    `json:"http_status,omitempty"`
+	Attempts        int    `json:"attempts"`
+	DurationMS      int64  `json:"duration_ms"`
+	ErrorClass      string `json:"error_class,omitempty"`
+	Error           string `json:"error,omitempty"`
+	ExcludedBecause string `json:"excluded_because,omitempty"`
+}
+
+// ServiceSummary tallies one service's results.
+type ServiceSummary struct {
+	Service      string `json:"service"`
+	Archived     int    `json:"archived"`
+	Failed       int    `json:"failed"`
+	Retried      int    `json:"retried"`
+	Paused       int    `json:"paused"`
+	Skipped      int    `json:"skipped"` // disallowed by robots.txt
+	BreakerTrips int    `json:"breaker_trips"`
+}
+
+// AtRisk is a citation whose URL failed on every service it was sent to.
+type AtRisk struct {
+	URL      string `json:"url"`
+	Citation string `json:"citation"`
+	File     string `json:"file"`
+	Line     int    `json:"line"`
+}
+
+// CanonicalMapping records a source spelling folded into a canonical URL.
+type CanonicalMapping struct {
+	Original  string `json:"original"`
+	Canonical string `json:"canonical"`
+}
+
+// ReportDoc is the structured form of a run report.
+type ReportDoc struct {
+	GeneratedAt string             `json:"generated_at"`
+	Left        int                `json:"jobs_left,omitempty"`
+	Services    []ServiceSummary   `json:"services"`
+	Rows        []ReportRow        `json:"rows"`
+	AtRisk      []AtRisk           `json:"at_risk,omitempty"`
+	Canonical   []CanonicalMapping `json:"canonical,omitempty"`
+}
+
+// reportFormat resolves -format, falling back to the -report extension and
+// then to text.
+func reportFormat(format, path string) (string, error) {
+	if format == "" {
+		switch strings.ToLower(filepath.Ext(path)) {
+		case ".json":
+			return formatJSON, nil
+		case ".jsonl", ".ndjson":
+			return formatJSONL, nil
+		case ".csv":
+			return formatCSV, nil
+		case ".html", ".htm":
+			return formatHTML, nil
+		}
+		return formatText, nil
+	}
+	switch format = strings.ToLower(format); format {
+	case formatText, formatJSON, formatJSONL, formatCSV, formatHTML:
+		return format, nil
+	}
+	return "", fmt.Errorf("unknown report format %q (want text, json, jsonl, csv or html)", format)
+}
+
+// errorClass buckets an archive error for reports: circuit-open, cancelled,
+// no-snapshot, robots-disallowed, rate-limited, server-error, client-error, or
+// the transport classes classifyError uses for link checks.
+func errorClass(err error) string {
+	var se *httpStatusError
+	switch {
+	case err == nil:
+		return ""
+	case errors.Is(err, errCircuitOpen):
+		return "circuit-open"
+	case errors.Is(err, context.Canceled):
+		return "cancelled"
+	case errors.Is(err, errNoSnapshot):
+		return "no-snapshot"
+	case errors.Is(err, errRobotsDisallowed):
+		return linkRobots
+	case errors.As(err, &se):
+		switch {
+		case se.Status == http.StatusTooManyRequests:
+			return "rate-limited"
+		case se.Status >= 500:
+			return "server-error"
+		}
+		return "client-error"
+	}
+	return classifyError(err)
+}
+
+// buildReport turns a run into its sorted, structured form.
+func buildReport(rep runReport, now time.Time) ReportDoc {
+	doc := ReportDoc{GeneratedAt: now.UTC().Format(time.RFC3339), Left: rep.Left}
+
+	stats := make(map[string]*ServiceSummary)
+	for _, r := range rep.Results {
+		t, ok := stats[r.Service]
+		if !ok {
+			t = &ServiceSummary{Service: r.Service}
+			stats[r.Service] = t
+		}
+		switch {
+		case r.Archived:
+			t.Archived++
+		case errors.Is(r.Error, errCircuitOpen):
+			t.Paused++
+		case errors.Is(r.Error, errRobotsDisallowed):
+			t.Skipped++
+		default:
+			t.Failed++
+		}
+		if r.Attempts > 1 {
+			t.Retried++
+		}
+
+		row := ReportRow{
+			URL:         r.URL,
+			Service:     r.Service,
+			Archived:    r.Archived,
+			SnapshotURL: r.SnapshotURL,
+			HTTPStatus:  r.HTTPStatus,
+			Attempts:    r.Attempts,
+			DurationMS:  r.Duration.Milliseconds(),
+			ErrorClass:  errorClass(r.Error),
+		}
+		if !r.SnapshotAt.IsZero() {
+			row.SnapshotAt = r.SnapshotAt.UTC().Format(time.RFC3339)
+		}
+		if r.Error != nil {
+			row.Error = r.Error.Error()
+		}
+		if errors.Is(r.Error, errRobotsDisallowed) {
+			row.ExcludedBecause = "robots.txt"
+		}
+		srcs := rep.Sources[r.URL]
+		if len(srcs) == 0 {
+			doc.Rows = append(doc.Rows, row)
+			continue
+		}
+		for _, src := range srcs {
+			sr := row
+			sr.File, sr.Line, sr.Type, sr.Slug, sr.Kind = src.File, src.Line, src.Type, src.Slug, src.Kind
+			if src.Citation != nil {
+				sr.Citation = src.Citation.String()
+			}
+			doc.Rows = append(doc.Rows, sr)
+		}
+	}
+	for _, e := range rep.Excluded {
+		for _, src := range e.Sources {
+			row := ReportRow{
+				File: src.File, Line: src.Line, Type: src.Type, Slug: src.Slug, Kind: src.Kind,
+				URL: e.URL, ExcludedBecause: e.Reason,
+			}
+			if src.Citation != nil {
+				row.Citation = src.Citation.String()
+			}
+			doc.Rows = append(doc.Rows, row)
+		}
+	}
+	for _, s := range rep.Skipped {
+		row := ReportRow{URL: s.URL, Service: s.Stage, ExcludedBecause: s.Reason}
+		srcs := rep.Sources[s.URL]
+		if len(srcs) == 0 {
+			doc.Rows = append(doc.Rows, row)
+			continue
+		}
+		for _, src := range srcs {
+			sr := row
+			sr.File, sr.Line, sr.Type, sr.Slug, sr.Kind = src.File, src.Line, src.Type, src.Slug, src.Kind
+			if src.Citation != nil {
+				sr.Citation = src.Citation.String()
+			}
+			doc.Rows = append(doc.Rows, sr)
+		}
+	}
+	for svc, t := range stats {
+		if b := rep.Breakers[svc]; b != nil {
+			t.BreakerTrips = b.Trips()
+		}
+		doc.Services = append(doc.Services, *t)
+	}
+	sort.Slice(doc.Services, func(i, j int) bool { return doc.Services[i].Service < doc.Services[j].Service })
+	sort.Slice(doc.Rows, func(i, j int) bool {
+		a, b := doc.Rows[i], doc.Rows[j]
+		if a.File != b.File {
+			return a.File < b.File
+		}
+		if a.Service != b.Service {
+			return a.Service < b.Service
+		}
+		if a.Line != b.Line {
+			return a.Line < b.Line
+		}
+		return a.URL < b.URL
+	})
+
+	// Citations whose URL failed on every service they were sent to.
+	archivedAnywhere := make(map[string]bool)
+	for _, r := range rep.Results {
+		archivedAnywhere[r.URL] = archivedAnywhere[r.URL] || r.Archived
+	}
+	for u, ok := range archivedAnywhere {
+		if ok {
+			continue
+		}
+		for _, src := range rep.Sources[u] {
+			if src.Citation != nil {
+				doc.AtRisk = append(doc.AtRisk, AtRisk{URL: u, Citation: src.Citation.String(), File: src.File, Line: src.Line})
+			}
+		}
+	}
+	sort.Slice(doc.AtRisk, func(i, j int) bool {
+		a, b := doc.AtRisk[i], doc.AtRisk[j]
+		if a.Citation != b.Citation {
+			return a.Citation < b.Citation
+		}
+		return a.URL < b.URL
+	})
+
+	// Source spellings that were folded into a canonical URL.
+	for u, srcs := range rep.Sources {
+		seen := make(map[string]bool)
+		for _, src := range srcs {
+			if src.Original != "" && src.Original != u && !seen[src.Original] {
+				seen[src.Original] = true
+				doc.Canonical = append(doc.Canonical, CanonicalMapping{Original: src.Original, Canonical: u})
+			}
+		}
+	}
+	sort.Slice(doc.Canonical, func(i, j int) bool { return doc.Canonical[i].Original < doc.Canonical[j].Original })
+	return doc
+}
+
+// writeReport writes rep to path in the given format (see reportFormat).
+func writeReport(path, format string, rep runReport) {
+	format, err := reportFormat(format, path)
+	if err != nil {
+		log.Fatalf("Report format error: %v", err)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		log.Fatalf("Report create error: %v", err)
+	}
+	defer f.Close()
+
+	if err := encodeReport(f, format, rep, buildReport(rep, time.Now())); err != nil {
+		log.Printf("Report write error: %v", err)
+	}
+}
+
+// encodeReport writes doc, built from rep, to w in a resolved format.
+func encodeReport(w io.Writer, format string, rep runReport, doc ReportDoc) error {
+	switch format {
+	case formatJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(doc)
+	case formatJSONL:
+		return writeReportJSONL(w, doc)
+	case formatCSV:
+		return writeReportCSV(w, doc)
+	case formatHTML:
+		return reportHTML.Execute(w, doc)
+	}
+	return writeReportText(w, rep, doc)
+}
+
+// writeReportText writes one line per result, sorted by URL and service,
+// with the sources citing it, followed by the summaries.
+func writeReportText(w io.Writer, rep runReport, doc ReportDoc) error {
+	results := append([]ArchiveResult(nil), rep.Results...)
+	sort.SliceStable(results, func(i, j int) bool {
+		if results[i].URL != results[j].URL {
+			return results[i].URL < results[j].URL
+		}
+		return results[i].Service < results[j].Service
+	})
+	var b strings.Builder
+	for _, r := range results {
+		b.WriteString(fmt.Sprintf("%s [%s] archived=%t status=%d attempts=%d time=%s snapshot=%s",
+			r.URL, r.Service, r.Archived, r.HTTPStatus, r.Attempts, r.Duration.Round(time.Millisecond), r.SnapshotURL))
+		if !r.SnapshotAt.IsZero() {
+			b.WriteString(" memento=" + r.SnapshotAt.UTC().Format(waybackTimeLayout))
+		}
+		if r.Error != nil {
+			b.WriteString(fmt.Sprintf(" error=%s (%v)", errorClass(r.Error), r.Error))
+		}
+		b.WriteString("\n")
+		for _, src := range rep.Sources[r.URL] {
+			if src.Citation != nil {
+				b.WriteString(fmt.Sprintf("    from %s:%d %s\n", src.File, src.Line, src.Citation))
+				continue
+			}
+			b.WriteString(fmt.Sprintf("    from %s:%d (%s)\n", src.File, src.Line, src.Kind))
+		}
+	}
+	for _, e := range rep.Excluded {
+		b.WriteString(fmt.Sprintf("%s [excluded] because=%s\n", e.URL, e.Reason))
+		for _, src := range e.Sources {
+			b.WriteString(fmt.Sprintf("    from %s:%d (%s)\n", src.File, src.Line, src.Kind))
+		}
+	}
+	for _, s := range rep.Skipped {
+		b.WriteString(fmt.Sprintf("%s [%s] skipped because=%s\n", s.URL, s.Stage, s.Reason))
+	}
+	b.WriteString("\n")
+	for _, s := range doc.Services {
+		b.WriteString(fmt.Sprintf("# %s: archived=%d failed=%d retried=%d paused=%d skipped=%d breaker_trips=%d\n",
+			s.Service, s.Archived, s.Failed, s.Retried, s.Paused, s.Skipped, s.BreakerTrips))
+	}
+	if len(rep.Excluded) > 0 {
+		b.WriteString(fmt.Sprintf("# excluded: %d URLs refused by policy\n", len(rep.Excluded)))
+	}
+	if len(rep.Skipped) > 0 {
+		b.WriteString(fmt.Sprintf("# skipped: %d text or mirror fetches ruled out by robots.txt\n", len(rep.Skipped)))
+	}
+	if doc.Left > 0 {
+		b.WriteString(fmt.Sprintf("# interrupted: %d jobs not finished (rerun with -resume)\n", doc.Left))
+	}
+	for _, a := range doc.AtRisk {
+		b.WriteString(fmt.Sprintf("# at risk: %s %s (%s:%d)\n", a.Citation, a.URL, a.File, a.Line))
+	}
+	for _, c := range doc.Canonical {
+		b.WriteString(fmt.Sprintf("# canonical: %s -> %s\n", c.Original, c.Canonical))
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// writeSkipReport writes the report for the text and mirror modes: the URLs
+// -policy refused and the ones robots.txt kept the mode from fetching.
+func writeSkipReport(path string, excluded []Exclusion, skipped []Skip) {
+	f, err := os.Create(path)
+	if err != nil {
+		log.Fatalf("Report create error: %v", err)
+	}
+	defer f.Close()
+	f.WriteString("# skipped by policy\n")
+	for _, e := range excluded {
+		f.WriteString(fmt.Sprintf("%s [excluded] because=%s\n", e.URL, e.Reason))
+	}
+	for _, s := range skipped {
+		f.WriteString(fmt.Sprintf("%s [%s] skipped because=%s\n", s.URL, s.Stage, s.Reason))
+	}
+	f.WriteString(fmt.Sprintf("\n# excluded: %d URLs refused by policy\n# skipped: %d URLs ruled out by robots.txt\n", len(excluded), len(skipped)))
+}
+
+// writeReportJSONL writes one JSON row per line; summaries are left to the
+// json format.
+func writeReportJSONL(w io.Writer, doc ReportDoc) error {
+	enc := json.NewEncoder(w)
+	for _, r := range doc.Rows {
+		if err := enc.Encode(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var reportCSVHeader = []string{
+	"file", "line", "type", "slug", "kind", "citation", "url", "service", "archived",
+	"snapshot_url", "snapshot_at", "http_status", "attempts", "duration_ms", "error_class", "error", "excluded_because",
+}
+
+func writeReportCSV(w io.Writer, doc ReportDoc) error {
+	cw := csv.NewWriter(w)
+	cw.Write(reportCSVHeader)
+	for _, r := range doc.Rows {
+		cw.Write([]string{
+			r.File, strconv.Itoa(r.Line), r.Type, r.Slug, r.Kind, r.Citation, r.URL, r.Service,
+			strconv.FormatBool(r.Archived), r.SnapshotURL, r.SnapshotAt, strconv.Itoa(r.HTTPStatus),
+			strconv.Itoa(r.Attempts), strconv.FormatInt(r.DurationMS, 10), r.ErrorClass, r.Error,
+			r.ExcludedBecause,
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// reportFileGroup is the rows of one source file, for the HTML dashboard.
+type reportFileGroup struct {
+	File     string
+	Rows     []ReportRow
+	Archived int
+	Failed   int
+	Excluded int
+}
+
+// Groups splits Rows (already sorted by file) into per-file sections.
+func (d ReportDoc) Groups() []reportFileGroup {
+	var groups []reportFileGroup
+	for _, r := range d.Rows {
+		if len(groups) == 0 || groups[len(groups)-1].File != r.File {
+			groups = append(groups, reportFileGroup{File: r.File})
+		}
+		g := &groups[len(groups)-1]
+		g.Rows = append(g.Rows, r)
+		switch {
+		case r.ExcludedBecause != "":
+			g.Excluded++
+		case r.Archived:
+			g.Archived++
+		default:
+			g.Failed++
+		}
+	}
+	return groups
+}
+
+var reportHTML = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>URL archive report {{.GeneratedAt}}</title>
+<style>
+body { font: 14px/1.4 system-ui, sans-serif; margin: 2rem; color: #222; }
+table { border-collapse: collapse; width: 100%; margin-bottom: 1.5rem; }
+th, td { border-bottom: 1px solid #ddd; padding: .3rem .5rem; text-align: left; vertical-align: top; }
+th { background: #f5f5f5; }
+td.url { word-break: break-all; }
+tr.failed td { background: #fff1f0; }
+tr.excluded td { color: #888; }
+details { margin-bottom: .5rem; }
+summary { cursor: pointer; font-family: monospace; }
+.ok { color: #237804; } .bad { color: #a8071a; }
+</style>
+</head>
+<body>
+<h1>URL archive report</h1>
+<p>Generated {{.GeneratedAt}}{{if .Left}} &middot; <span class="bad">interrupted with {{.Left}} jobs left</span>{{end}}</p>
+
+<h2>Services</h2>
+<table>
+<tr><th>Service</th><th>Archived</th><th>Failed</th><th>Retried</th><th>Paused</th><th>Skipped (robots.txt)</th><th>Breaker trips</th></tr>
+{{range .Services}}<tr><td>{{.Service}}</td><td class="ok">{{.Archived}}</td><td class="bad">{{.Failed}}</td><td>{{.Retried}}</td><td>{{.Paused}}</td><td>{{.Skipped}}</td><td>{{.BreakerTrips}}</td></tr>
+{{end}}</table>
+
+{{if .AtRisk}}<h2>At risk</h2>
+<table>
+<tr><th>Citation</th><th>URL</th><th>Source</th></tr>
+{{range .AtRisk}}<tr><td>{{.Citation}}</td><td class="url">{{.URL}}</td><td>{{.File}}:{{.Line}}</td></tr>
+{{end}}</table>
+{{end}}
+<h2>By source file</h2>
+{{range .Groups}}<details{{if .Failed}} open{{end}}>
+<summary>{{if .File}}{{.File}}{{else}}(no source){{end}} &mdash; <span class="ok">{{.Archived}} archived</span>, <span class="bad">{{.Failed}} failed</span>{{if .Excluded}}, {{.Excluded}} excluded{{end}}</summary>
+<table>
+<tr><th>Line</th><th>URL</th><th>Service</th><th>Status</th><th>Attempts</th><th>Time (ms)</th><th>Snapshot / error / excluded because</th></tr>
+{{range .Rows}}<tr{{if .ExcludedBecause}} class="excluded"{{else if not .Archived}} class="failed"{{end}}><td>{{.Line}}</td><td class="url">{{.URL}}{{if .Citation}}<br><small>{{.Citation}}</small>{{end}}</td><td>{{.Service}}</td><td>{{.HTTPStatus}}</td><td>{{.Attempts}}</td><td>{{.DurationMS}}</td><td class="url">{{if .ExcludedBecause}}excluded: {{.ExcludedBecause}}{{else if .Archived}}<a href="{{.SnapshotURL}}">{{.SnapshotURL}}</a>{{if .SnapshotAt}}<br><small>captured {{.SnapshotAt}}</small>{{end}}{{else}}{{.ErrorClass}}: {{.Error}}{{end}}</td></tr>
+{{end}}</table>
+</details>
+{{end}}
+{{if .Canonical}}<h2>Canonicalised URLs</h2>
+<table>
+<tr><th>As written</th><th>Canonical</th></tr>
+{{range .Canonical}}<tr><td class="url">{{.Original}}</td><td class="url">{{.Canonical}}</td></tr>
+{{end}}</table>
+{{end}}</body>
+</html>
+`))
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden report files in testdata/golden")
+
+// goldenTime is when the golden reports were generated.
+var goldenTime = time.Date(2026, 10, 17, 9, 30, 40, 0, time.UTC)
+
+// goldenRun is a run touching every part of the report: a citation archived
+// on one service and failed on another, an at-risk citation, a policy
+// exclusion, a robots.txt skip, a canonicalised spelling, a tripped breaker
+// and jobs left by an interruption.
+func goldenRun() runReport {
+	knuth := &Citation{Kind: refBibliography, Key: "knuth1974", Author: "Donald E. Knuth", Title: "Computer Programming as an Art"}
+	note := &Citation{Kind: refMarginNote, Key: "mn-1", Title: "On Tools"}
+	breaker := newCircuitBreaker(1, time.Minute)
+	breaker.Report(false, goldenTime)
+	return runReport{
+		Results: []ArchiveResult{
+			{URL: "https://example.com/essay", Service: "archive.org", Archived: true, Verified: true, HTTPStatus: 200, Attempts: 1, Duration: 1500 * time.Millisecond,
+				SnapshotURL: "https://web.archive.org/web/20261017093012/https://example.com/essay", SnapshotAt: time.Date(2026, 10, 17, 9, 30, 12, 0, time.UTC)},
+			{URL: "https://example.com/essay", Service: "archive.today", HTTPStatus: 503, Attempts: 3, Duration: 4200 * time.Millisecond,
+				Error: &httpStatusError{Prefix: "archive.today", Status: 503}},
+			{URL: "https://dl.acm.org/doi/10.1145/361604.361612", Service: "archive.org", Attempts: 2, Duration: 61 * time.Second,
+				Error: fmt.Errorf("archive.org: %w", errNoSnapshot)},
+			{URL: "https://dl.acm.org/doi/10.1145/361604.361612", Service: "archive.today", Error: errCircuitOpen},
+			{URL: "https://example.com/private", Service: "warc", Error: errRobotsDisallowed},
+		},
+		Sources: map[string][]URLRef{
+			"https://example.com/essay": {
+				{URL: "https://example.com/essay", Original: "http://EXAMPLE.com/essay/?utm_source=feed", File: "content/essays/one.mdx", Line: 12, Kind: refInline, Type: "essays", Slug: "one"},
+				{URL: "https://example.com/essay", File: "content/notes/margin-notes.json", Line: 4, Kind: refMarginNote, Type: "notes", Slug: "tools", Citation: note},
+			},
+			"https://dl.acm.org/doi/10.1145/361604.361612": {
+				{URL: "https://dl.acm.org/doi/10.1145/361604.361612", File: "content/essays/bibliography.json", Line: 8, Kind: refBibliography, Type: "essays", Slug: "one", Citation: knuth},
+			},
+			"https://example.com/private": {
+				{URL: "https://example.com/private", File: "content/essays/one.mdx", Line: 30, Kind: refBare, Type: "essays", Slug: "one"},
+			},
+			"https://example.com/paper.pdf": {
+				{URL: "https://example.com/paper.pdf", File: "content/essays/one.mdx", Line: 40, Kind: refInline, Type: "essays", Slug: "one"},
+			},
+		},
+		Excluded: []Exclusion{{
+			URL: "https://drive.google.com/file/d/1", Reason: "private drive",
+			Sources: []URLRef{{URL: "https://drive.google.com/file/d/1", File: "content/essays/one.mdx", Line: 20, Kind: refInline, Type: "essays", Slug: "one"}},
+		}},
+		Skipped:  []Skip{{URL: "https://example.com/paper.pdf", Stage: "mirror", Reason: "robots.txt"}},
+		Breakers: map[string]*circuitBreaker{"archive.today": breaker},
+		Left:     2,
+	}
+}
+
+func TestReportGolden(t *testing.T) {
+	rep := goldenRun()
+	doc := buildReport(rep, goldenTime)
+	for _, format := range []string{formatText, formatJSON, formatJSONL, formatCSV, formatHTML} {
+		var buf bytes.Buffer
+		if err := encodeReport(&buf, format, rep, doc); err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+		path := filepath.Join("testdata", "golden", "report."+format)
+		if *updateGolden {
+			if err := os.WriteFile(path, buf.Bytes(), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		want, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("%v (run go test -update to create it)", err)
+		}
+		if !bytes.Equal(buf.Bytes(), want) {
+			t.Errorf("%s report differs from %s (run go test -update if the change is intended):\n%s", format, path, buf.String())
+		}
+	}
+}
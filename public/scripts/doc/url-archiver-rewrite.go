@@ -0,0 +1,249 @@
+// -----------------------------------------------------------------------------
+// File:          url-archiver-rewrite.go
+// Description:   Wayback fallback rewriting for URLArchiverV1 ("rewrite"). For
+//                every cited URL the check mode has confirmed dead, find the
+//                best snapshot from before it broke, write a rewrite map, and
+//                with -apply swap the links in page.mdx / bibliography.json
+//                for the archived copy. Without -apply it prints a diff.
+// Author:        Kris Yotam
+// License:       CC-0
+// -----------------------------------------------------------------------------
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Rewrite maps one dead URL to the snapshot that should replace it.
+type Rewrite struct {
+	URL       string   `json:"url"`
+	Snapshot  string   `json:"snapshot"`
+	Timestamp string   `json:"timestamp"`
+	Status    string   `json:"status"` // link state from the last check
+	Sources   []string `json:"sources"`
+}
+
+// lineEdit is one changed line in a source file.
+type lineEdit struct {
+	Line     int
+	Old, New string
+}
+
+// runRewrite is the "rewrite" mode.
+func runRewrite(ctx context.Context, cfg config) {
+	ledger, err := openLedger(cfg.LedgerPath)
+	if err != nil {
+		log.Fatalf("Failed to open ledger: %v", err)
+	}
+	defer ledger.Close()
+	dead, err := ledger.ConfirmedDead(cfg.ConfirmAfter)
+	if err != nil {
+		log.Fatalf("Failed to read link checks: %v", err)
+	}
+	if len(dead) == 0 {
+		fmt.Println("No confirmed dead links; run check first.")
+		return
+	}
+
+	set, err := gatherRefs(cfg)
+	if err != nil {
+		log.Fatalf("Failed to collect URLs: %v", err)
+	}
+	sources := refsByURL(set.Refs)
+
+	lookup := newWaybackLookup(defaultHTTPClient(cfg.UserAgent), cfg.WaybackAPI)
+	var rewrites []Rewrite
+	var missing []string
+	for _, d := range dead {
+		if ctx.Err() != nil {
+			break
+		}
+		if len(sources[d.URL]) == 0 {
+			continue // no longer cited anywhere
+		}
+		snap, err := lookup.BestBefore(ctx, d.URL, d.FirstBrokenAt)
+		if err != nil {
+			log.Printf("Wayback lookup %s: %v", d.URL, err)
+			continue
+		}
+		if snap == nil {
+			missing = append(missing, d.URL)
+			continue
+		}
+		rw := Rewrite{URL: d.URL, Snapshot: snap.URL, Timestamp: snap.Timestamp.Format(waybackTimeLayout), Status: d.Status}
+		for _, src := range sources[d.URL] {
+			rw.Sources = append(rw.Sources, fmt.Sprintf("%s:%d", src.File, src.Line))
+		}
+		rewrites = append(rewrites, rw)
+	}
+
+	if err := writeRewriteMap(cfg.RewriteMap, rewrites); err != nil {
+		log.Fatalf("Rewrite map write error: %v", err)
+	}
+	fmt.Printf("%d dead links with snapshots, %d without. Rewrite map: %s\n", len(rewrites), len(missing), cfg.RewriteMap)
+	for _, u := range missing {
+		fmt.Printf("  no snapshot: %s\n", u)
+	}
+
+	edits := planRewrites(rewrites, sources)
+	files := make([]string, 0, len(edits))
+	for f := range edits {
+		files = append(files, f)
+	}
+	sort.Strings(files)
+	for _, f := range files {
+		if !cfg.Apply {
+			printEditDiff(os.Stdout, f, edits[f])
+			continue
+		}
+		if err := applyEdits(f, edits[f]); err != nil {
+			log.Printf("Rewrite %s: %v", f, err)
+			continue
+		}
+		fmt.Printf("Rewrote %d lines in %s\n", len(edits[f]), f)
+	}
+	if !cfg.Apply && len(files) > 0 {
+		fmt.Println("Dry run: rerun with -apply to write these changes.")
+	}
+}
+
+func writeRewriteMap(path string, rewrites []Rewrite) error {
+	sort.Slice(rewrites, func(i, j int) bool { return rewrites[i].URL < rewrites[j].URL })
+	data, err := json.MarshalIndent(rewrites, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// planRewrites works out the line edits for every file citing a rewritten
+// URL. Each source occurrence is replaced using the spelling found in the
+// file, so canonicalised URLs still match.
+func planRewrites(rewrites []Rewrite, sources map[string][]URLRef) map[string][]lineEdit {
+	type target struct {
+		file string
+		line int
+	}
+	repl := make(map[target]map[string]string)
+	for _, rw := range rewrites {
+		for _, src := range sources[rw.URL] {
+			t := target{src.File, src.Line}
+			if repl[t] == nil {
+				repl[t] = make(map[string]string)
+			}
+			orig := src.Original
+			if orig == "" {
+				orig = src.URL
+			}
+			repl[t][orig] = rw.Snapshot
+		}
+	}
+
+	edits := make(map[string][]lineEdit)
+	cache := make(map[string][]string)
+	for t, subs := range repl {
+		lines, ok := cache[t.file]
+		if !ok {
+			data, err := os.ReadFile(t.file)
+			if err != nil {
+				log.Printf("Read error %s: %v", t.file, err)
+				continue
+			}
+			lines = strings.Split(string(data), "\n")
+			cache[t.file] = lines
+		}
+		if t.line < 1 || t.line > len(lines) {
+			continue
+		}
+		old := lines[t.line-1]
+		updated := old
+		// Longest first so a URL that prefixes another is not hit early.
+		origs := make([]string, 0, len(subs))
+		for o := range subs {
+			origs = append(origs, o)
+		}
+		sort.Slice(origs, func(i, j int) bool { return len(origs[i]) > len(origs[j]) })
+		for _, o := range origs {
+			updated = replaceURLToken(updated, o, subs[o])
+		}
+		if updated != old {
+			edits[t.file] = append(edits[t.file], lineEdit{Line: t.line, Old: old, New: updated})
+		}
+	}
+	for f := range edits {
+		sort.Slice(edits[f], func(i, j int) bool { return edits[f][i].Line < edits[f][j].Line })
+	}
+	return edits
+}
+
+// replaceURLToken replaces whole-URL occurrences of old in line. A match must
+// not be preceded or followed by a URL character, which keeps us from
+// touching longer URLs or an already-archived web.archive.org/web/.../old.
+// Sentence punctuation after a match only ends it when nothing URL-like
+// follows, so "old." is replaced but old.html, old?b=1 and old:8080 are not.
+func replaceURLToken(line, old, repl string) string {
+	var out strings.Builder
+	for {
+		i := strings.Index(line, old)
+		if i < 0 {
+			out.WriteString(line)
+			return out.String()
+		}
+		end := i + len(old)
+		before := i == 0 || !isURLByte(line[i-1])
+		j := end
+		for j < len(line) && strings.IndexByte(".,;:!?", line[j]) >= 0 {
+			j++
+		}
+		after := j == len(line) || !isURLByte(line[j])
+		if before && after {
+			out.WriteString(line[:i])
+			out.WriteString(repl)
+		} else {
+			out.WriteString(line[:end])
+		}
+		line = line[end:]
+	}
+}
+
+func isURLByte(c byte) bool {
+	return c > ' ' && c < 0x7f && strings.IndexByte("\"'<>()[]{}`\\", c) < 0
+}
+
+// printEditDiff writes a unified-style preview of edits to w.
+func printEditDiff(w io.Writer, file string, edits []lineEdit) {
+	fmt.Fprintf(w, "--- a/%s\n+++ b/%s\n", file, file)
+	for _, e := range edits {
+		fmt.Fprintf(w, "@@ -%d +%d @@\n-%s\n+%s\n", e.Line, e.Line, e.Old, e.New)
+	}
+}
+
+// applyEdits rewrites file in place, checking each line still matches what
+// the plan was built from.
+func applyEdits(file string, edits []lineEdit) error {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	lines := bytes.Split(data, []byte("\n"))
+	for _, e := range edits {
+		if e.Line > len(lines) || string(lines[e.Line-1]) != e.Old {
+			return fmt.Errorf("line %d changed since planning; skipped file", e.Line)
+		}
+		lines[e.Line-1] = []byte(e.New)
+	}
+	info, err := os.Stat(file)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(file, bytes.Join(lines, []byte("\n")), info.Mode().Perm())
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestReplaceURLToken(t *testing.T) {
+	const old, repl = "https://example.com/a", "ARCHIVED"
+	cases := []struct{ line, want string }{
+		{"see https://example.com/a", "see ARCHIVED"},
+		{"see https://example.com/a.", "see ARCHIVED."},
+		{"(https://example.com/a), then", "(ARCHIVED), then"},
+		{"is it https://example.com/a?!", "is it ARCHIVED?!"},
+		{"[link](https://example.com/a).", "[link](ARCHIVED)."},
+		{"at https://example.com/a: more", "at ARCHIVED: more"},
+		// Longer URLs that start with old are left alone.
+		{"https://example.com/a.html", "https://example.com/a.html"},
+		{"https://example.com/a?b=1", "https://example.com/a?b=1"},
+		{"https://example.com/a:8080", "https://example.com/a:8080"},
+		{"https://example.com/a/b", "https://example.com/a/b"},
+		{"https://web.archive.org/web/2020/https://example.com/a", "https://web.archive.org/web/2020/https://example.com/a"},
+	}
+	for _, c := range cases {
+		if got := replaceURLToken(c.line, old, repl); got != c.want {
+			t.Errorf("replaceURLToken(%q) = %q, want %q", c.line, got, c.want)
+		}
+	}
+}
+
+func TestWaybackLookupBestBefore(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/wayback/available", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("url") != "https://example.com/essay" || r.URL.Query().Get("timestamp") != "20240101000000" {
+			t.Errorf("availability query = %s", r.URL.RawQuery)
+		}
+		io.WriteString(w, `{"archived_snapshots":{"closest":{"available":true,"status":"200",
+			"url":"http://web.archive.org/web/20240301000000/https://example.com/essay","timestamp":"20240301000000"}}}`)
+	})
+	mux.HandleFunc("/cdx/search/cdx", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("to") != "20240101000000" {
+			t.Errorf("cdx query = %s", r.URL.RawQuery)
+		}
+		io.WriteString(w, `[["timestamp","original","statuscode"],
+			["20220505050505","https://example.com/essay","200"],
+			["20230606060606","https://example.com/essay","200"]]`)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	lookup := newWaybackLookup(srv.Client(), srv.URL)
+	at := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	closest, err := lookup.Closest(context.Background(), "https://example.com/essay", at)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "https://web.archive.org/web/20240301000000/https://example.com/essay"; closest == nil || closest.URL != want {
+		t.Fatalf("closest = %+v, want %s", closest, want)
+	}
+
+	// The closest capture is after at, so BestBefore falls back to CDX.
+	snap, err := lookup.BestBefore(context.Background(), "https://example.com/essay", at)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "https://web.archive.org/web/20230606060606/https://example.com/essay"; snap == nil || snap.URL != want {
+		t.Fatalf("best before = %+v, want %s", snap, want)
+	}
+	if !snap.Timestamp.Equal(time.Date(2023, 6, 6, 6, 6, 6, 0, time.UTC)) || snap.Status != http.StatusOK {
+		t.Errorf("best before = %v status %d", snap.Timestamp, snap.Status)
+	}
+}
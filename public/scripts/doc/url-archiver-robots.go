@@ -0,0 +1,267 @@
+// -----------------------------------------------------------------------------
+// File:          url-archiver-robots.go
+// Description:   robots.txt handling for URLArchiverV1's direct fetches (link
+//                checks, text snapshots, WARC captures and document mirrors).
+//                Each host's robots.txt is fetched once per run and parsed as
+//                RFC 9309 describes, with the group for our User-Agent product
+//                token taking precedence over "*"; its Crawl-delay slows the
+//                host limiter down for that host. Submissions to third-party
+//                archives are not direct fetches and are not affected.
+// Author:        Kris Yotam
+// License:       CC-0
+// -----------------------------------------------------------------------------
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errRobotsDisallowed marks a fetch skipped because robots.txt forbids it.
+var errRobotsDisallowed = errors.New("robots.txt disallows this URL for our user agent")
+
+// maxRobotsBody is how much of a robots.txt is parsed; RFC 9309 asks for
+// at least 500 KiB.
+const maxRobotsBody = 500 << 10
+
+// maxCrawlDelay caps the Crawl-delay we honor so a single host cannot stall
+// a run indefinitely.
+const maxCrawlDelay = time.Minute
+
+// robotsRule is one Allow or Disallow line.
+type robotsRule struct {
+	allow   bool
+	length  int // pattern length, for longest-match precedence
+	pattern *regexp.Regexp
+}
+
+// robotsRules is the group of a robots.txt that applies to us.
+type robotsRules struct {
+	rules      []robotsRule
+	crawlDelay time.Duration
+	disallowed bool // robots.txt was unreachable with a server error
+}
+
+// Allows reports whether pathQuery (path plus any ?query) may be fetched.
+// The longest matching pattern wins and Allow wins ties.
+func (r robotsRules) Allows(pathQuery string) bool {
+	if r.disallowed {
+		return false
+	}
+	if pathQuery == "/robots.txt" {
+		return true
+	}
+	best, allow := -1, true
+	for _, rule := range r.rules {
+		if rule.length < best || !rule.pattern.MatchString(pathQuery) {
+			continue
+		}
+		if rule.length > best || rule.allow {
+			best, allow = rule.length, rule.allow
+		}
+	}
+	return allow
+}
+
+// robotsPattern compiles a path pattern with * wildcards and an optional
+// trailing $ anchor.
+func robotsPattern(p string) *regexp.Regexp {
+	anchored := strings.HasSuffix(p, "$")
+	p = strings.TrimSuffix(p, "$")
+	expr := "^" + strings.ReplaceAll(regexp.QuoteMeta(p), `\*`, ".*")
+	if anchored {
+		expr += "$"
+	}
+	return regexp.MustCompile(expr)
+}
+
+// parseRobots returns the rules in data for token, merging every group
+// naming it and falling back to the "*" groups when none does.
+func parseRobots(data []byte, token string) robotsRules {
+	var mine, star robotsRules
+	var agents []string
+	inRules := false // the current group's user-agent lines have ended
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	sc.Buffer(make([]byte, 64<<10), maxRobotsBody)
+	foundMine := false
+	for sc.Scan() {
+		line := sc.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		key, value = strings.ToLower(strings.TrimSpace(key)), strings.TrimSpace(value)
+		if key == "user-agent" {
+			if inRules {
+				agents, inRules = nil, false
+			}
+			agents = append(agents, strings.ToLower(value))
+			continue
+		}
+		inRules = true
+		var targets []*robotsRules
+		for _, a := range agents {
+			switch a {
+			case token:
+				targets = append(targets, &mine)
+				foundMine = true
+			case "*":
+				targets = append(targets, &star)
+			}
+		}
+		for _, t := range targets {
+			switch key {
+			case "allow", "disallow":
+				if value == "" {
+					continue // an empty Disallow allows everything
+				}
+				t.rules = append(t.rules, robotsRule{allow: key == "allow", length: len(value), pattern: robotsPattern(value)})
+			case "crawl-delay":
+				if secs, err := strconv.ParseFloat(value, 64); err == nil && secs > 0 {
+					t.crawlDelay = min(time.Duration(secs*float64(time.Second)), maxCrawlDelay)
+				}
+			}
+		}
+	}
+	if foundMine {
+		return mine
+	}
+	return star
+}
+
+// agentToken is the product token of a User-Agent string, lowercased, as
+// robots.txt groups name it: "URLArchiverV1/1.0 (...)" gives "urlarchiverv1".
+func agentToken(agent string) string {
+	token, _, _ := strings.Cut(strings.TrimSpace(agent), " ")
+	token, _, _ = strings.Cut(token, "/")
+	return strings.ToLower(token)
+}
+
+// robotsSite is one origin's robots.txt, fetched on first use.
+type robotsSite struct {
+	once  sync.Once
+	rules robotsRules
+}
+
+// robotsCache fetches and caches robots.txt per origin for one run. A nil
+// cache (-robots=false) allows everything.
+type robotsCache struct {
+	client *http.Client
+	token  string
+	hosts  *hostLimiter // told about each host's Crawl-delay
+
+	mu    sync.Mutex
+	sites map[string]*robotsSite
+}
+
+// fetchGuard is what every direct fetch in one invocation shares: the
+// client, the per-host limiter and the robots.txt cache, so a Crawl-delay
+// learned by one stage slows the host down for every other stage too.
+type fetchGuard struct {
+	client *http.Client
+	hosts  *hostLimiter
+	robots *robotsCache
+}
+
+func newFetchGuard(cfg config) *fetchGuard {
+	client := defaultHTTPClient(cfg.UserAgent)
+	hosts := newHostLimiter(cfg.HostRate)
+	return &fetchGuard{client: client, hosts: hosts, robots: newRobotsCache(cfg, client, hosts)}
+}
+
+// newRobotsCache returns the run's robots.txt cache, or nil when -robots
+// is off.
+func newRobotsCache(cfg config, client *http.Client, hosts *hostLimiter) *robotsCache {
+	if !cfg.Robots {
+		return nil
+	}
+	return &robotsCache{client: client, token: agentToken(cfg.UserAgent), hosts: hosts, sites: make(map[string]*robotsSite)}
+}
+
+// Allowed reports whether target may be fetched, loading its origin's
+// robots.txt the first time the origin is seen.
+func (c *robotsCache) Allowed(ctx context.Context, target string) bool {
+	if c == nil {
+		return true
+	}
+	u, err := url.Parse(target)
+	if err != nil || u.Host == "" {
+		return true
+	}
+	origin := strings.ToLower(u.Scheme + "://" + u.Host)
+	c.mu.Lock()
+	site, ok := c.sites[origin]
+	if !ok {
+		site = &robotsSite{}
+		c.sites[origin] = site
+	}
+	c.mu.Unlock()
+	site.once.Do(func() {
+		site.rules = c.fetch(ctx, origin)
+		if site.rules.crawlDelay > 0 && c.hosts != nil {
+			c.hosts.SetDelay(u.Hostname(), site.rules.crawlDelay)
+		}
+	})
+	pathQuery := u.EscapedPath()
+	if pathQuery == "" {
+		pathQuery = "/"
+	}
+	if u.RawQuery != "" {
+		pathQuery += "?" + u.RawQuery
+	}
+	return site.rules.Allows(pathQuery)
+}
+
+// fetch loads origin's robots.txt. As RFC 9309 says, a 4xx means no rules
+// and a 5xx means stay away; a host we cannot reach at all gets no rules,
+// so the fetch that follows fails and is reported on its own.
+func (c *robotsCache) fetch(ctx context.Context, origin string) robotsRules {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, origin+"/robots.txt", nil)
+	if err != nil {
+		return robotsRules{}
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return robotsRules{}
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode >= 500:
+		return robotsRules{disallowed: true}
+	case resp.StatusCode >= 400:
+		return robotsRules{}
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxRobotsBody))
+	if err != nil {
+		return robotsRules{}
+	}
+	return parseRobots(data, c.token)
+}
+
+// userAgentTransport sets User-Agent on requests that do not carry one.
+type userAgentTransport struct {
+	base  http.RoundTripper
+	agent string
+}
+
+func (t *userAgentTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Header.Get("User-Agent") == "" {
+		req = req.Clone(req.Context())
+		req.Header.Set("User-Agent", t.agent)
+	}
+	return t.base.RoundTrip(req)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFetchGuardSharesCrawlDelay(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/robots.txt" {
+			io.WriteString(w, "User-agent: *\nCrawl-delay: 2\nDisallow: /private/\n")
+		}
+	}))
+	defer srv.Close()
+	host := mustHost(t, srv.URL)
+
+	cfg := config{UserAgent: "URLArchiverV1/test", Robots: true, Services: "warc", WARCDir: t.TempDir()}
+	guard := newFetchGuard(cfg)
+	if !guard.robots.Allowed(context.Background(), srv.URL+"/essay") {
+		t.Fatal("/essay should be allowed")
+	}
+	if guard.robots.Allowed(context.Background(), srv.URL+"/private/notes") {
+		t.Error("/private/ should be disallowed")
+	}
+
+	archivers, _, err := newArchivers(cfg, guard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeArchivers(archivers)
+	g := archivers[0].(*guardedArchiver)
+	if g.hosts != guard.hosts {
+		t.Fatal("archivers should share the run's host limiter")
+	}
+	b := g.hosts.bucket(host)
+	b.mu.Lock()
+	rate := b.rate
+	b.mu.Unlock()
+	if rate != 0.5 {
+		t.Errorf("rate for %s = %v, want 0.5 from Crawl-delay 2", host, rate)
+	}
+}
+
+func mustHost(t *testing.T, raw string) string {
+	t.Helper()
+	u, err := url.Parse(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u.Hostname()
+}
+
+func TestReportListsRobotsSkips(t *testing.T) {
+	rep := runReport{
+		Sources: map[string][]URLRef{"https://example.com/paper.pdf": {{File: "content/essays/one.md", Line: 3, Kind: "markdown"}}},
+		Skipped: []Skip{{URL: "https://example.com/paper.pdf", Stage: "mirror", Reason: "robots.txt"}},
+	}
+	doc := buildReport(rep, time.Now())
+	if len(doc.Rows) != 1 {
+		t.Fatalf("got %d rows, want 1", len(doc.Rows))
+	}
+	if r := doc.Rows[0]; r.Service != "mirror" || r.ExcludedBecause != "robots.txt" || r.File != "content/essays/one.md" {
+		t.Errorf("row = %+v, want the mirror skip attributed to its source", r)
+	}
+	var b strings.Builder
+	if err := writeReportText(&b, rep, doc); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(b.String(), "https://example.com/paper.pdf [mirror] skipped because=robots.txt") {
+		t.Errorf("text report does not list the skip:\n%s", b.String())
+	}
+}
@@ -0,0 +1,357 @@
+// -----------------------------------------------------------------------------
+// File:          url-archiver-services.go
+// Description:   Archival service backends for URLArchiverV1 (Wayback Machine,
+//                archive.today, Ghostarchive)
+// Author:        Kris Yotam
+// License:       CC-0
+// -----------------------------------------------------------------------------
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Archiver is one archival service a URL can be submitted to. Each backend
+// produces its own ArchiveResult so one outage never hides the others.
+type Archiver interface {
+	Name() string
+	Archive(ctx context.Context, target string) ArchiveResult
+}
+
+// archiverOptions carries the settings shared by every backend constructor.
+type archiverOptions struct {
+	Client     *http.Client
+	WARCDir    string
+	WaybackAPI string       // Save Page Now and availability endpoint
+	Robots     *robotsCache // consulted by backends that fetch pages themselves
+	Hosts      *hostLimiter // paces those backends' fetches beyond the first
+}
+
+// archiverRegistry maps the names accepted by -services to constructors.
+var archiverRegistry = map[string]func(archiverOptions) Archiver{
+	"archive.org": func(o archiverOptions) Archiver {
+		return newWaybackArchiver(o.Client, o.WaybackAPI)
+	},
+	"archive.today": func(o archiverOptions) Archiver {
+		return &archiveTodayArchiver{client: o.Client, endpoint: "https://archive.ph"}
+	},
+	"ghostarchive": func(o archiverOptions) Archiver {
+		return &ghostArchiver{client: o.Client, endpoint: "https://ghostarchive.org"}
+	},
+	"warc": func(o archiverOptions) Archiver {
+		return newWARCArchiver(o.Client, o.WARCDir, o.Robots, o.Hosts)
+	},
+}
+
+// registeredServices lists the backend names in a stable order for help text.
+func registeredServices() []string {
+	names := make([]string, 0, len(archiverRegistry))
+	for name := range archiverRegistry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// buildArchivers resolves a comma-separated -services value into backends.
+func buildArchivers(spec string, opts archiverOptions) ([]Archiver, error) {
+	var archivers []Archiver
+	seen := make(map[string]bool)
+	for _, name := range strings.Split(spec, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" || seen[name] {
+			continue
+		}
+		ctor, ok := archiverRegistry[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown service %q (available: %s)", name, strings.Join(registeredServices(), ", "))
+		}
+		seen[name] = true
+		archivers = append(archivers, ctor(opts))
+	}
+	if len(archivers) == 0 {
+		return nil, fmt.Errorf("no archival services selected")
+	}
+	return archivers, nil
+}
+
+// noRedirectClient copies c but stops at the first redirect so submission
+// endpoints that answer with a Location header can be read directly.
+func noRedirectClient(c *http.Client) *http.Client {
+	nc := *c
+	nc.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	return &nc
+}
+
+// snapshotFromResponse pulls the snapshot location out of a submission
+// response: a redirect Location, a Refresh header, or the final request URL.
+func snapshotFromResponse(resp *http.Response, base string) string {
+	loc := resp.Header.Get("Location")
+	if loc == "" {
+		if refresh := resp.Header.Get("Refresh"); refresh != "" {
+			if i := strings.Index(strings.ToLower(refresh), "url="); i >= 0 {
+				loc = strings.TrimSpace(refresh[i+len("url="):])
+			}
+		}
+	}
+	if loc == "" {
+		return ""
+	}
+	if strings.HasPrefix(loc, "/") {
+		loc = strings.TrimRight(base, "/") + loc
+	}
+	return loc
+}
+
+// -----------------------------------------------------------------------------
+// Wayback Machine
+// -----------------------------------------------------------------------------
+
+type waybackArchiver struct {
+	client   *http.Client
+	endpoint string
+	lookup   *waybackLookup
+
+	// verifyTries and verifyDelay bound how long we poll the availability
+	// API for a capture Save Page Now did not name in its headers.
+	verifyTries int
+	verifyDelay time.Duration
+	// now is the clock submissions and lookups are timed by; tests stop it
+	// so recorded availability queries match.
+	now func() time.Time
+}
+
+func newWaybackArchiver(client *http.Client, endpoint string) *waybackArchiver {
+	return &waybackArchiver{
+		client:      client,
+		endpoint:    endpoint,
+		lookup:      newWaybackLookup(client, endpoint),
+		verifyTries: 3,
+		verifyDelay: 10 * time.Second,
+		now:         time.Now,
+	}
+}
+
+// spnReuseWindow is how old a capture Save Page Now may hand back instead of
+// taking a new one; anything older means our submission produced nothing.
+const spnReuseWindow = time.Hour
+
+// errNoSnapshot marks a submission that looked successful but left no
+// capture behind, such as a 200 carrying Save Page Now's error page or an
+// answer with no snapshot location. The service rejected the page, so it is
+// neither retried nor held against the service.
+var errNoSnapshot = errors.New("no snapshot appeared")
+
+func (w *waybackArchiver) Name() string { return "archive.org" }
+
+func (w *waybackArchiver) Archive(ctx context.Context, target string) ArchiveResult {
+	submitted := w.now()
+	spn, err := savePageNow(ctx, w.client, w.endpoint, target)
+	res := ArchiveResult{URL: target, Service: w.Name(), HTTPStatus: spn.Status, Error: err}
+	if err != nil {
+		return res
+	}
+	snap, err := w.verify(ctx, target, spn, submitted)
+	if err != nil {
+		res.Error = err
+		return res
+	}
+	res.Archived, res.SnapshotURL, res.SnapshotAt = true, snap.URL, snap.Timestamp
+	res.Verified = snap.Status >= 200 && snap.Status < 300
+	return res
+}
+
+// verify confirms a capture of target exists that is no older than the
+// reuse window before submitted: first from the memento headers Save Page Now
+// returned, then by polling the availability API. The snapshot's Status is
+// the captured page's status as the availability API reports it, or 0 when
+// that is unknown.
+func (w *waybackArchiver) verify(ctx context.Context, target string, spn spnResponse, submitted time.Time) (*Snapshot, error) {
+	earliest := submitted.Add(-spnReuseWindow)
+	if spn.Snapshot != "" && !spn.MementoAt.IsZero() && !spn.MementoAt.Before(earliest) {
+		// The headers name the capture but not what it captured, which may
+		// be an error page; only the lookup knows its status.
+		snap := &Snapshot{URL: spn.Snapshot, Timestamp: spn.MementoAt}
+		if found, err := w.lookup.Closest(ctx, target, spn.MementoAt); err == nil && found != nil && found.Timestamp.Equal(spn.MementoAt) {
+			snap.Status = found.Status
+		}
+		return snap, nil
+	}
+	var lastErr error
+	for try := 1; try <= w.verifyTries; try++ {
+		snap, err := w.lookup.Closest(ctx, target, w.now())
+		switch {
+		case err != nil:
+			lastErr = err
+		case snap != nil && !snap.Timestamp.Before(earliest):
+			return snap, nil
+		}
+		if try < w.verifyTries {
+			if err := sleepCtx(ctx, w.verifyDelay); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if lastErr != nil {
+		return nil, fmt.Errorf("save page now: verify: %w", lastErr)
+	}
+	return nil, fmt.Errorf("save page now: %w (status %d)", errNoSnapshot, spn.Status)
+}
+
+// spnResponse is what a Save Page Now response said about the capture.
+type spnResponse struct {
+	Status    int
+	Snapshot  string    // absolute replay URL from Content-Location
+	MementoAt time.Time // from Memento-Datetime, else the snapshot URL
+}
+
+// waybackSnapshotPath matches the timestamp in a /web/<ts>/<url> replay path.
+var waybackSnapshotPath = regexp.MustCompile(`/web/(\d{14})(?:[a-z_]{2,3})?/`)
+
+// savePageNow submits target to the Wayback Machine and reports the status,
+// the snapshot URL from Content-Location and its memento timestamp.
+func savePageNow(ctx context.Context, client *http.Client, endpoint, target string) (spnResponse, error) {
+	var spn spnResponse
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint+"/save/"+target, nil)
+	if err != nil {
+		return spn, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return spn, err
+	}
+	defer resp.Body.Close()
+	spn.Status = resp.StatusCode
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return spn, statusError("save page now", resp)
+	}
+	spn.Snapshot = resp.Header.Get("Content-Location")
+	if strings.HasPrefix(spn.Snapshot, "/") {
+		spn.Snapshot = endpoint + spn.Snapshot
+	}
+	if t, err := http.ParseTime(resp.Header.Get("Memento-Datetime")); err == nil {
+		spn.MementoAt = t.UTC()
+	} else if m := waybackSnapshotPath.FindStringSubmatch(spn.Snapshot); m != nil {
+		spn.MementoAt, _ = time.Parse(waybackTimeLayout, m[1])
+	}
+	return spn, nil
+}
+
+// snapshotLive reports whether snapshot answers a HEAD with a 2xx. Services
+// that only hand back a location are trusted to have captured the page once
+// the location actually serves something.
+func snapshotLive(ctx context.Context, client *http.Client, snapshot string) bool {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, snapshot, nil)
+	if err != nil {
+		return false
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode >= 200 && resp.StatusCode < 300
+}
+
+// -----------------------------------------------------------------------------
+// archive.today
+// -----------------------------------------------------------------------------
+
+type archiveTodayArchiver struct {
+	client   *http.Client
+	endpoint string
+}
+
+func (a *archiveTodayArchiver) Name() string { return "archive.today" }
+
+func (a *archiveTodayArchiver) Archive(ctx context.Context, target string) ArchiveResult {
+	res := ArchiveResult{URL: target, Service: a.Name()}
+	form := url.Values{"url": {target}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.endpoint+"/submit/", strings.NewReader(form.Encode()))
+	if err != nil {
+		res.Error = err
+		return res
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := noRedirectClient(a.client).Do(req)
+	if err != nil {
+		res.Error = err
+		return res
+	}
+	defer resp.Body.Close()
+	res.HTTPStatus = resp.StatusCode
+	if resp.StatusCode >= 400 {
+		res.Error = statusError("archive.today", resp)
+		return res
+	}
+	res.SnapshotURL = snapshotFromResponse(resp, a.endpoint)
+	if res.SnapshotURL == "" {
+		res.Error = fmt.Errorf("archive.today: %w: no snapshot location in response (status %d)", errNoSnapshot, resp.StatusCode)
+		return res
+	}
+	res.Archived = true
+	res.Verified = snapshotLive(ctx, a.client, res.SnapshotURL)
+	return res
+}
+
+// -----------------------------------------------------------------------------
+// Ghostarchive
+// -----------------------------------------------------------------------------
+
+type ghostArchiver struct {
+	client   *http.Client
+	endpoint string
+}
+
+func (g *ghostArchiver) Name() string { return "ghostarchive" }
+
+func (g *ghostArchiver) Archive(ctx context.Context, target string) ArchiveResult {
+	res := ArchiveResult{URL: target, Service: g.Name()}
+	form := url.Values{"archive": {target}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, g.endpoint+"/archive2", strings.NewReader(form.Encode()))
+	if err != nil {
+		res.Error = err
+		return res
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := noRedirectClient(g.client).Do(req)
+	if err != nil {
+		res.Error = err
+		return res
+	}
+	defer resp.Body.Close()
+	res.HTTPStatus = resp.StatusCode
+	if resp.StatusCode >= 400 {
+		res.Error = statusError("ghostarchive", resp)
+		return res
+	}
+	res.SnapshotURL = snapshotFromResponse(resp, g.endpoint)
+	if res.SnapshotURL == "" {
+		res.Error = fmt.Errorf("ghostarchive: %w: no snapshot location in response (status %d)", errNoSnapshot, resp.StatusCode)
+		return res
+	}
+	res.Archived = true
+	res.Verified = snapshotLive(ctx, g.client, res.SnapshotURL)
+	return res
+}
+
+// defaultHTTPClient is shared by every backend. Every request it sends
+// identifies itself as agent and goes through httpTransport, which tests
+// swap for a cassette replayer.
+func defaultHTTPClient(agent string) *http.Client {
+	return &http.Client{
+		Timeout:   30 * time.Second,
+		Transport: &userAgentTransport{base: httpTransport, agent: agent},
+	}
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const (
+	testEndpoint = "https://web.archive.org"
+	testTarget   = "https://example.com/essay"
+	testSnapshot = "https://web.archive.org/web/20261017093012/https://example.com/essay"
+)
+
+// replayClient returns a client answering from testdata/cassettes/name and
+// fails the test if any recorded interaction goes unused.
+func replayClient(t *testing.T, name string, timeout time.Duration) *http.Client {
+	t.Helper()
+	c, err := loadCassette(filepath.Join("testdata", "cassettes", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	replay := newCassetteReplayer(c)
+	t.Cleanup(func() {
+		if unused := replay.Unused(); len(unused) > 0 {
+			t.Errorf("unused interactions: %v", unused)
+		}
+	})
+	saved := httpTransport
+	httpTransport = replay
+	t.Cleanup(func() { httpTransport = saved })
+	client := defaultHTTPClient("URLArchiverV1/test")
+	client.Timeout = timeout
+	return client
+}
+
+func TestSavePageNowSuccess(t *testing.T) {
+	client := replayClient(t, "spn_success.json", time.Second)
+	spn, err := savePageNow(context.Background(), client, testEndpoint, testTarget)
+	if err != nil {
+		t.Fatalf("savePageNow: %v", err)
+	}
+	if spn.Status != http.StatusOK {
+		t.Errorf("status = %d, want 200", spn.Status)
+	}
+	if spn.Snapshot != testSnapshot {
+		t.Errorf("snapshot = %q, want %q", spn.Snapshot, testSnapshot)
+	}
+	want := time.Date(2026, 10, 17, 9, 30, 12, 0, time.UTC)
+	if !spn.MementoAt.Equal(want) {
+		t.Errorf("memento = %v, want %v", spn.MementoAt, want)
+	}
+}
+
+func TestSavePageNowRateLimited(t *testing.T) {
+	client := replayClient(t, "spn_rate_limited.json", time.Second)
+	spn, err := savePageNow(context.Background(), client, testEndpoint, testTarget)
+	var se *httpStatusError
+	if !errors.As(err, &se) {
+		t.Fatalf("err = %v, want httpStatusError", err)
+	}
+	if spn.Status != http.StatusTooManyRequests || se.Status != http.StatusTooManyRequests {
+		t.Errorf("status = %d/%d, want 429", spn.Status, se.Status)
+	}
+	if se.RetryAfter != 2*time.Minute {
+		t.Errorf("retry after = %v, want 2m", se.RetryAfter)
+	}
+	if !retryable(err) {
+		t.Error("429 should be retryable")
+	}
+	if got := errorClass(err); got != "rate-limited" {
+		t.Errorf("error class = %q, want rate-limited", got)
+	}
+	// The retry delay honors Retry-After over the backoff schedule.
+	policy := retryPolicy{MaxAttempts: 4, BaseDelay: time.Second, MaxDelay: time.Hour}
+	if d := policy.delay(1, err); d < 2*time.Minute {
+		t.Errorf("retry delay = %v, want at least Retry-After", d)
+	}
+}
+
+func TestSavePageNowServerError(t *testing.T) {
+	client := replayClient(t, "spn_server_error.json", time.Second)
+	spn, err := savePageNow(context.Background(), client, testEndpoint, testTarget)
+	if err == nil {
+		t.Fatal("want an error for 503")
+	}
+	if spn.Status != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want 503", spn.Status)
+	}
+	if !retryable(err) {
+		t.Error("5xx should be retryable")
+	}
+	if got := errorClass(err); got != "server-error" {
+		t.Errorf("error class = %q, want server-error", got)
+	}
+}
+
+func TestSavePageNowRedirect(t *testing.T) {
+	client := replayClient(t, "spn_redirect.json", time.Second)
+	spn, err := savePageNow(context.Background(), client, testEndpoint, testTarget)
+	if err != nil {
+		t.Fatalf("savePageNow: %v", err)
+	}
+	if spn.Status != http.StatusOK {
+		t.Errorf("status = %d, want 200 after following the redirect", spn.Status)
+	}
+	if spn.Snapshot != testSnapshot {
+		t.Errorf("snapshot = %q, want %q", spn.Snapshot, testSnapshot)
+	}
+	// Without Memento-Datetime the timestamp comes from the replay path.
+	want := time.Date(2026, 10, 17, 9, 30, 12, 0, time.UTC)
+	if !spn.MementoAt.Equal(want) {
+		t.Errorf("memento = %v, want %v", spn.MementoAt, want)
+	}
+}
+
+func TestSavePageNowTimeout(t *testing.T) {
+	client := replayClient(t, "spn_timeout.json", 50*time.Millisecond)
+	start := time.Now()
+	_, err := savePageNow(context.Background(), client, testEndpoint, testTarget)
+	if err == nil {
+		t.Fatal("want a timeout error")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("took %v; the client timeout should cut the 5s response short", elapsed)
+	}
+	if got := errorClass(err); got != linkTimeout {
+		t.Errorf("error class = %q, want %s (%v)", got, linkTimeout, err)
+	}
+	if !retryable(err) {
+		t.Error("timeouts should be retryable")
+	}
+}
+
+// testNow is shortly after the captures recorded in the cassettes.
+var testNow = time.Date(2026, 10, 17, 9, 30, 40, 0, time.UTC)
+
+// testWayback returns the real archive.org backend with its clock stopped at
+// testNow and availability polling cut to two quick tries.
+func testWayback(client *http.Client) *waybackArchiver {
+	w := newWaybackArchiver(client, testEndpoint)
+	w.verifyTries, w.verifyDelay = 2, 0
+	w.now = func() time.Time { return testNow }
+	return w
+}
+
+func testGuarded(a Archiver) *guardedArchiver {
+	return &guardedArchiver{
+		Archiver: a,
+		hosts:    newHostLimiter(0),
+		breaker:  newCircuitBreaker(5, time.Minute),
+		retry:    retryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: 10 * time.Millisecond},
+	}
+}
+
+func TestGuardedArchiverRetriesServerError(t *testing.T) {
+	client := replayClient(t, "spn_retry.json", time.Second)
+	res := testGuarded(testWayback(client)).Archive(context.Background(), testTarget)
+	if res.Error != nil || !res.Archived {
+		t.Fatalf("archive failed: %v", res.Error)
+	}
+	if res.Attempts != 2 {
+		t.Errorf("attempts = %d, want 2 (503 then 200)", res.Attempts)
+	}
+	// Content-Location names the capture; the availability lookup for its
+	// timestamp confirms it was a 200.
+	if res.SnapshotURL != testSnapshot || !res.Verified {
+		t.Errorf("snapshot = %q verified %v, want %q verified", res.SnapshotURL, res.Verified, testSnapshot)
+	}
+}
+
+func TestWaybackArchiverCapturedErrorIsUnverified(t *testing.T) {
+	client := replayClient(t, "spn_captured_error.json", time.Second)
+	res := testWayback(client).Archive(context.Background(), testTarget)
+	if res.Error != nil || !res.Archived {
+		t.Fatalf("archive failed: %v", res.Error)
+	}
+	if res.SnapshotURL != testSnapshot {
+		t.Errorf("snapshot = %q, want %q", res.SnapshotURL, testSnapshot)
+	}
+	if res.Verified {
+		t.Error("a capture of a 404 page should not be verified")
+	}
+}
+
+func TestWaybackArchiverVerifiesWithAvailability(t *testing.T) {
+	client := replayClient(t, "spn_no_location.json", time.Second)
+	res := testWayback(client).Archive(context.Background(), testTarget)
+	if res.Error != nil || !res.Archived || !res.Verified {
+		t.Fatalf("archived %v verified %v: %v", res.Archived, res.Verified, res.Error)
+	}
+	if res.SnapshotURL != testSnapshot {
+		t.Errorf("snapshot = %q, want %q", res.SnapshotURL, testSnapshot)
+	}
+	if want := time.Date(2026, 10, 17, 9, 30, 12, 0, time.UTC); !res.SnapshotAt.Equal(want) {
+		t.Errorf("snapshot at = %v, want %v", res.SnapshotAt, want)
+	}
+}
+
+func TestWaybackArchiverErrorPageLeavesNoSnapshot(t *testing.T) {
+	client := replayClient(t, "spn_error_page.json", time.Second)
+	g := testGuarded(testWayback(client))
+	g.breaker = newCircuitBreaker(1, time.Minute)
+	res := g.Archive(context.Background(), testTarget)
+	if res.Archived || !errors.Is(res.Error, errNoSnapshot) {
+		t.Fatalf("archived %v, err = %v; want errNoSnapshot", res.Archived, res.Error)
+	}
+	if res.HTTPStatus != http.StatusOK {
+		t.Errorf("status = %d, want the 200 error page", res.HTTPStatus)
+	}
+	// The page was rejected, not the service, so there is no retry and the
+	// breaker stays closed.
+	if res.Attempts != 1 {
+		t.Errorf("attempts = %d, want 1", res.Attempts)
+	}
+	if !g.breaker.PausedUntil().IsZero() {
+		t.Error("breaker opened on a non-retryable failure")
+	}
+}
+
+func TestReplayMissIsAnError(t *testing.T) {
+	client := replayClient(t, "spn_success.json", time.Second)
+	if _, err := savePageNow(context.Background(), client, testEndpoint, "https://example.com/other"); !errors.Is(err, errCassetteMiss) {
+		t.Errorf("err = %v, want a cassette miss", err)
+	}
+	// Use up the recorded interaction so the cleanup check passes.
+	if _, err := savePageNow(context.Background(), client, testEndpoint, testTarget); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLocationServicesVerifySnapshot(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /submit/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Location", "/AbC12")
+		w.WriteHeader(http.StatusFound)
+	})
+	mux.HandleFunc("HEAD /AbC12", func(w http.ResponseWriter, r *http.Request) {})
+	mux.HandleFunc("POST /archive2", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Refresh", "0; url=/archive/gone")
+	})
+	mux.HandleFunc("HEAD /archive/gone", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	today := (&archiveTodayArchiver{client: srv.Client(), endpoint: srv.URL}).Archive(context.Background(), testTarget)
+	if !today.Archived || !today.Verified || today.SnapshotURL != srv.URL+"/AbC12" {
+		t.Errorf("archive.today = %+v, want a verified %s/AbC12", today, srv.URL)
+	}
+	ghost := (&ghostArchiver{client: srv.Client(), endpoint: srv.URL}).Archive(context.Background(), testTarget)
+	if !ghost.Archived || ghost.Verified {
+		t.Errorf("ghostarchive = %+v, want archived but unverified when the snapshot 404s", ghost)
+	}
+}
+
+func TestMissingLocationIsNotRetried(t *testing.T) {
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		io.WriteString(w, "<html>Something went wrong</html>")
+	}))
+	defer srv.Close()
+
+	g := testGuarded(&archiveTodayArchiver{client: srv.Client(), endpoint: srv.URL})
+	g.breaker = newCircuitBreaker(1, time.Minute)
+	res := g.Archive(context.Background(), testTarget)
+	if !errors.Is(res.Error, errNoSnapshot) {
+		t.Fatalf("err = %v, want errNoSnapshot", res.Error)
+	}
+	if calls != 1 || res.Attempts != 1 {
+		t.Errorf("%d calls in %d attempts, want 1", calls, res.Attempts)
+	}
+	if !g.breaker.PausedUntil().IsZero() {
+		t.Error("breaker opened on a rejected submission")
+	}
+}
@@ -0,0 +1,449 @@
+// -----------------------------------------------------------------------------
+// File:          url-archiver-text.go
+// Description:   Readable text snapshots for URLArchiverV1. Stores a cleaned
+//                Markdown copy of each cited HTML page (title, byline, date,
+//                main text) under public/, keyed by canonical URL, with a
+//                JSON index, so popups on the site can preview a source even
+//                after the origin is gone. Taken after archive runs and, for
+//                older citations, by the "text" mode.
+// Author:        Kris Yotam
+// License:       CC-0
+// -----------------------------------------------------------------------------
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// minSnapshotText is the shortest main text worth keeping; anything
+	// less is a login wall, cookie banner or script-rendered shell.
+	minSnapshotText = 200
+	// excerptLength is the length in runes of the index excerpt.
+	excerptLength = 280
+)
+
+var (
+	titleRegex    = regexp.MustCompile(`(?is)<title\b[^>]*>(.*?)</title\s*>`)
+	h1Regex       = regexp.MustCompile(`(?is)<h1\b[^>]*>(.*?)</h1\s*>`)
+	metaRegex     = regexp.MustCompile(`(?is)<meta\b[^>]*>`)
+	attrRegex     = regexp.MustCompile(`(?is)([a-z:_-]+)\s*=\s*(?:"([^"]*)"|'([^']*)')`)
+	timeRegex     = regexp.MustCompile(`(?is)<time\b[^>]*\bdatetime\s*=\s*["']([^"']+)["']`)
+	articleRegex  = regexp.MustCompile(`(?is)<article\b[^>]*>(.*)</article\s*>`)
+	mainRegex     = regexp.MustCompile(`(?is)<main\b[^>]*>(.*)</main\s*>|<div\b[^>]*\brole\s*=\s*["']main["'][^>]*>(.*)</div\s*>`)
+	bodyRegex     = regexp.MustCompile(`(?is)<body\b[^>]*>(.*)</body\s*>`)
+	chromeRegex   = regexp.MustCompile(`(?is)<(nav|header|footer|aside|form|button|iframe|select|figure)\b.*?</(nav|header|footer|aside|form|button|iframe|select|figure)\s*>`)
+	preRegex      = regexp.MustCompile(`(?is)<pre\b[^>]*>(.*?)</pre\s*>`)
+	headingRegex  = regexp.MustCompile(`(?is)<h([1-6])\b[^>]*>(.*?)</h[1-6]\s*>`)
+	quoteRegex    = regexp.MustCompile(`(?is)<blockquote\b[^>]*>(.*?)</blockquote\s*>`)
+	itemRegex     = regexp.MustCompile(`(?is)<li\b[^>]*>`)
+	breakRegex    = regexp.MustCompile(`(?is)<br\s*/?>`)
+	blockTagRegex = regexp.MustCompile(`(?is)</?(p|div|section|ul|ol|dl|dt|dd|table|tr|hr|figcaption|address|details|summary)\b[^>]*>`)
+)
+
+// TextSnapshot is the readable copy of one cited page.
+type TextSnapshot struct {
+	URL       string
+	Title     string
+	Byline    string
+	Date      string
+	FetchedAt time.Time
+	Text      string // Markdown
+}
+
+// TextIndexEntry is one page in the text snapshot index.
+type TextIndexEntry struct {
+	File      string `json:"file"` // site path of the Markdown copy
+	Title     string `json:"title,omitempty"`
+	Byline    string `json:"byline,omitempty"`
+	Date      string `json:"date,omitempty"`
+	FetchedAt string `json:"fetched_at"`
+	Excerpt   string `json:"excerpt"`
+	Words     int    `json:"words"`
+}
+
+// textSnapshotName is the file name of url's text snapshot.
+func textSnapshotName(url string) string {
+	return urlKey(url) + ".md"
+}
+
+// metaContent returns the first non-empty content of a <meta> whose name or
+// property is one of keys, in the order given.
+func metaContent(doc string, keys ...string) string {
+	found := make(map[string]string)
+	for _, tag := range metaRegex.FindAllString(doc, -1) {
+		attrs := make(map[string]string)
+		for _, m := range attrRegex.FindAllStringSubmatch(tag, -1) {
+			attrs[strings.ToLower(m[1])] = m[2] + m[3]
+		}
+		key := strings.ToLower(attrs["name"] + attrs["property"] + attrs["itemprop"])
+		if c := cleanInline(attrs["content"]); c != "" && found[key] == "" {
+			found[key] = c
+		}
+	}
+	for _, k := range keys {
+		if v := found[k]; v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// cleanInline strips tags from an HTML fragment and collapses it to one line.
+func cleanInline(s string) string {
+	return strings.Join(strings.Fields(html.UnescapeString(tagRegex.ReplaceAllString(s, " "))), " ")
+}
+
+// extractReadable pulls the title, byline, date and main text out of an
+// HTML page. ok is false for non-HTML responses and pages with too little
+// text to be worth keeping.
+func extractReadable(url string, page fetchedPage) (snap TextSnapshot, ok bool) {
+	if ct := strings.ToLower(page.ContentType); ct != "" && !strings.Contains(ct, "html") {
+		return TextSnapshot{}, false
+	}
+	doc := string(page.Body)
+	snap = TextSnapshot{URL: url}
+
+	snap.Title = metaContent(doc, "og:title", "twitter:title", "citation_title", "dc.title")
+	if snap.Title == "" {
+		if m := titleRegex.FindStringSubmatch(doc); m != nil {
+			snap.Title = cleanInline(m[1])
+		} else if m := h1Regex.FindStringSubmatch(doc); m != nil {
+			snap.Title = cleanInline(m[1])
+		}
+	}
+	snap.Byline = metaContent(doc, "author", "article:author", "citation_author", "dc.creator", "byl")
+	snap.Date = metaContent(doc, "article:published_time", "citation_publication_date", "citation_date", "dc.date", "date", "datepublished")
+	if snap.Date == "" {
+		if m := timeRegex.FindStringSubmatch(doc); m != nil {
+			snap.Date = strings.TrimSpace(m[1])
+		}
+	}
+
+	content := doc
+	for _, re := range []*regexp.Regexp{articleRegex, mainRegex, bodyRegex} {
+		if m := re.FindStringSubmatch(doc); m != nil {
+			content = strings.Join(m[1:], "")
+			break
+		}
+	}
+	snap.Text = htmlToMarkdown(content)
+	if len([]rune(snap.Text)) < minSnapshotText {
+		return TextSnapshot{}, false
+	}
+	return snap, true
+}
+
+// htmlToMarkdown converts the main content of a page to plain Markdown:
+// headings, paragraphs, list items, quotes and preformatted blocks survive,
+// links are reduced to their text and page chrome is dropped.
+func htmlToMarkdown(s string) string {
+	s = dropElementRegex.ReplaceAllString(s, " ")
+	s = chromeRegex.ReplaceAllString(s, " ")
+
+	// Preformatted text keeps its layout; \x00 and \x01 stand in for its
+	// line breaks and spaces until the rest of the whitespace is collapsed.
+	s = preRegex.ReplaceAllStringFunc(s, func(m string) string {
+		body := html.UnescapeString(tagRegex.ReplaceAllString(preRegex.FindStringSubmatch(m)[1], ""))
+		body = strings.NewReplacer("\n", "\x00", " ", "\x01", "\t", "\x01\x01\x01\x01").Replace(strings.Trim(body, "\n"))
+		return "\n\n```\x00" + body + "\x00```\n\n"
+	})
+	s = headingRegex.ReplaceAllStringFunc(s, func(m string) string {
+		sub := headingRegex.FindStringSubmatch(m)
+		return "\n\n" + strings.Repeat("#", int(sub[1][0]-'0')) + " " + cleanInline(sub[2]) + "\n\n"
+	})
+	s = quoteRegex.ReplaceAllStringFunc(s, func(m string) string {
+		inner := blockTagRegex.ReplaceAllString(quoteRegex.FindStringSubmatch(m)[1], "\n")
+		var lines []string
+		for _, l := range strings.Split(inner, "\n") {
+			if l = cleanInline(l); l != "" {
+				lines = append(lines, "> "+l)
+			}
+		}
+		return "\n\n" + strings.Join(lines, "\n>\n") + "\n\n"
+	})
+	s = itemRegex.ReplaceAllString(s, "\n- ")
+	s = breakRegex.ReplaceAllString(s, "\n")
+	s = blockTagRegex.ReplaceAllString(s, "\n\n")
+	s = html.UnescapeString(tagRegex.ReplaceAllString(s, ""))
+
+	var out []string
+	blank := true
+	for _, l := range strings.Split(s, "\n") {
+		l = strings.Join(strings.Fields(l), " ")
+		if l == "" || l == "-" {
+			if !blank {
+				out = append(out, "")
+			}
+			blank = true
+			continue
+		}
+		out = append(out, strings.NewReplacer("\x00", "\n", "\x01", " ").Replace(l))
+		blank = false
+	}
+	return strings.TrimSpace(strings.Join(out, "\n"))
+}
+
+// Markdown renders the snapshot with YAML frontmatter.
+func (t TextSnapshot) Markdown() string {
+	var b strings.Builder
+	b.WriteString("---\n")
+	fmt.Fprintf(&b, "url: %q\n", t.URL)
+	for _, f := range []struct{ key, val string }{{"title", t.Title}, {"byline", t.Byline}, {"date", t.Date}} {
+		if f.val != "" {
+			fmt.Fprintf(&b, "%s: %q\n", f.key, f.val)
+		}
+	}
+	fmt.Fprintf(&b, "fetched_at: %s\n", t.FetchedAt.UTC().Format(time.RFC3339))
+	b.WriteString("---\n\n")
+	if t.Title != "" {
+		b.WriteString("# " + t.Title + "\n\n")
+	}
+	b.WriteString(t.Text + "\n")
+	return b.String()
+}
+
+// excerpt is the opening of the text, without headings, code or Markdown
+// marks, cut at a word boundary.
+func (t TextSnapshot) excerpt() string {
+	var words []string
+	fence := false
+	for _, l := range strings.Split(t.Text, "\n") {
+		if strings.HasPrefix(l, "```") {
+			fence = !fence
+			continue
+		}
+		if fence || strings.HasPrefix(l, "#") {
+			continue
+		}
+		words = append(words, strings.Fields(strings.TrimLeft(l, "->"))...)
+	}
+	var b strings.Builder
+	for _, w := range words {
+		if len([]rune(b.String()))+len([]rune(w)) > excerptLength {
+			b.WriteString("…")
+			break
+		}
+		if b.Len() > 0 {
+			b.WriteString(" ")
+		}
+		b.WriteString(w)
+	}
+	return b.String()
+}
+
+// textStore is the directory of text snapshots and its index.
+type textStore struct {
+	dir      string
+	sitePath string
+	index    map[string]TextIndexEntry
+}
+
+// openTextStore loads the index in dir, which must be under public/.
+func openTextStore(dir string) (*textStore, error) {
+	sitePath := publicURI("", dir)
+	if sitePath == "" {
+		return nil, fmt.Errorf("%s is not under public/, so the site cannot serve it", dir)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	ts := &textStore{dir: dir, sitePath: sitePath, index: make(map[string]TextIndexEntry)}
+	data, err := os.ReadFile(filepath.Join(dir, "index.json"))
+	if errors.Is(err, os.ErrNotExist) {
+		return ts, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var idx struct {
+		URLs map[string]TextIndexEntry `json:"urls"`
+	}
+	if err := json.Unmarshal(data, &idx); err != nil {
+		return nil, fmt.Errorf("index.json: %w", err)
+	}
+	for u, e := range idx.URLs {
+		ts.index[u] = e
+	}
+	return ts, nil
+}
+
+// Has reports whether url already has a snapshot on disk.
+func (ts *textStore) Has(url string) bool {
+	_, err := os.Stat(filepath.Join(ts.dir, textSnapshotName(url)))
+	return err == nil
+}
+
+// Save writes snap's Markdown copy and indexes it.
+func (ts *textStore) Save(snap TextSnapshot) error {
+	name := textSnapshotName(snap.URL)
+	if err := os.WriteFile(filepath.Join(ts.dir, name), []byte(snap.Markdown()), 0644); err != nil {
+		return err
+	}
+	ts.index[snap.URL] = TextIndexEntry{
+		File:      ts.sitePath + "/" + name,
+		Title:     snap.Title,
+		Byline:    snap.Byline,
+		Date:      snap.Date,
+		FetchedAt: snap.FetchedAt.UTC().Format(time.RFC3339),
+		Excerpt:   snap.excerpt(),
+		Words:     len(strings.Fields(snap.Text)),
+	}
+	return nil
+}
+
+// Close writes the index.
+func (ts *textStore) Close() error {
+	idx := struct {
+		GeneratedAt string                    `json:"generated_at"`
+		URLs        map[string]TextIndexEntry `json:"urls"`
+	}{time.Now().UTC().Format(time.RFC3339), ts.index}
+	data, err := json.MarshalIndent(idx, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(ts.dir, "index.json"), append(data, '\n'), 0644)
+}
+
+// capturePages refetches pages archived in this run to store what later
+// runs need from them: drift baselines for tracked citations and readable
+// text snapshots for pages that have none. Each page is fetched once. It
+// returns the pages robots.txt kept it from fetching.
+func capturePages(ctx context.Context, cfg config, guard *fetchGuard, ledger *Ledger, results []ArchiveResult, tracked map[string]bool) []Skip {
+	baseline := needBaseline(ledger, results, tracked)
+	var store *textStore
+	if cfg.TextDir != "" {
+		var err error
+		if store, err = openTextStore(cfg.TextDir); err != nil {
+			log.Printf("Text snapshots disabled: %v", err)
+		}
+	}
+	text := make(map[string]bool)
+	if store != nil {
+		for _, r := range results {
+			if r.Archived && !store.Has(r.URL) {
+				text[r.URL] = true
+			}
+		}
+	}
+
+	var urls []string
+	for u := range baseline {
+		urls = append(urls, u)
+	}
+	for u := range text {
+		if !baseline[u] {
+			urls = append(urls, u)
+		}
+	}
+	if len(urls) == 0 {
+		return nil
+	}
+	sort.Strings(urls)
+	baselines, texts := 0, 0
+	var skipped []Skip
+	fetchPages(ctx, cfg, guard, urls, func(u string, page fetchedPage, err error) {
+		if errors.Is(err, errRobotsDisallowed) {
+			skipped = append(skipped, Skip{URL: u, Stage: "text", Reason: "robots.txt"})
+			return
+		}
+		if err != nil {
+			log.Printf("Fetch %s: %v", u, err)
+			return
+		}
+		now := time.Now()
+		if baseline[u] {
+			if err := ledger.SaveBaseline(u, page.Fingerprint(), now); err != nil {
+				log.Printf("Ledger write error %s: %v", u, err)
+			} else {
+				baselines++
+			}
+		}
+		if text[u] {
+			if snap, ok := extractReadable(u, page); ok {
+				snap.FetchedAt = now
+				if err := store.Save(snap); err != nil {
+					log.Printf("Text snapshot write error %s: %v", u, err)
+				} else {
+					texts++
+				}
+			}
+		}
+	})
+	if len(baseline) > 0 {
+		fmt.Printf("Stored content baselines for %d of %d cited pages\n", baselines, len(baseline))
+	}
+	if store != nil {
+		if err := store.Close(); err != nil {
+			log.Printf("Text index write error: %v", err)
+		}
+		fmt.Printf("Stored text snapshots for %d of %d pages in %s\n", texts, len(text), cfg.TextDir)
+	}
+	sortSkips(skipped)
+	return skipped
+}
+
+// runText is the "text" mode: it takes text snapshots of every cited page
+// that has none yet, such as citations archived before snapshots existed.
+func runText(ctx context.Context, cfg config) {
+	if cfg.TextDir == "" {
+		log.Fatalf("-textDir is empty, so there is nowhere to store snapshots")
+	}
+	set, err := gatherRefs(cfg)
+	if err != nil {
+		log.Fatalf("Failed to collect URLs: %v", err)
+	}
+	store, err := openTextStore(cfg.TextDir)
+	if err != nil {
+		log.Fatalf("Text store error: %v", err)
+	}
+	var urls []string
+	for _, u := range uniqueURLs(set.Refs) {
+		if !store.Has(u) {
+			urls = append(urls, u)
+		}
+	}
+	fmt.Printf("%d cited URLs without a text snapshot\n", len(urls))
+	saved, skipped := 0, 0
+	var blocked []Skip
+	fetchPages(ctx, cfg, newFetchGuard(cfg), urls, func(u string, page fetchedPage, err error) {
+		if errors.Is(err, errRobotsDisallowed) {
+			blocked = append(blocked, Skip{URL: u, Stage: "text", Reason: "robots.txt"})
+			return
+		}
+		if err != nil {
+			log.Printf("Fetch %s: %v", u, err)
+			return
+		}
+		snap, ok := extractReadable(u, page)
+		if !ok {
+			skipped++
+			return
+		}
+		snap.FetchedAt = time.Now()
+		if err := store.Save(snap); err != nil {
+			log.Printf("Text snapshot write error %s: %v", u, err)
+			return
+		}
+		saved++
+	})
+	if err := store.Close(); err != nil {
+		log.Fatalf("Text index write error: %v", err)
+	}
+	sortSkips(blocked)
+	writeSkipReport(cfg.ReportPath, set.Excluded, blocked)
+	fmt.Printf("Text complete: %d saved, %d not HTML or too short, %d disallowed by robots.txt, %d failed. Index: %s. Report: %s\n",
+		saved, skipped, len(blocked), len(urls)-saved-skipped-len(blocked), filepath.Join(cfg.TextDir, "index.json"), cfg.ReportPath)
+}
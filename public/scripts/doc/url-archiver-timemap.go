@@ -0,0 +1,230 @@
+// -----------------------------------------------------------------------------
+// File:          url-archiver-timemap.go
+// Description:   Memento TimeMaps (RFC 7089) for URLArchiverV1 ("timemap").
+//                Writes one application/link-format TimeMap per cited URL,
+//                merging our own WARC captures with the third-party snapshots
+//                in the ledger (and optionally every Wayback capture), plus a
+//                static JSON index the site uses to show "archived" links
+//                beside each citation.
+// Author:        Kris Yotam
+// License:       CC-0
+// -----------------------------------------------------------------------------
+
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// TimeMapEntry is one URL in the JSON index.
+type TimeMapEntry struct {
+	TimeMap  string         `json:"timemap"` // site path of the link-format TimeMap
+	First    string         `json:"first"`
+	Last     string         `json:"last"`
+	Mementos []IndexMemento `json:"mementos"`
+}
+
+// IndexMemento is a memento as listed in the JSON index.
+type IndexMemento struct {
+	URI      string `json:"uri"`
+	Datetime string `json:"datetime"` // RFC 3339
+	Service  string `json:"service"`
+}
+
+// TimeMapIndex is the JSON index written next to the TimeMaps. Aliases maps
+// each spelling used in the sources to the canonical URL keying URLs.
+type TimeMapIndex struct {
+	GeneratedAt string                  `json:"generated_at"`
+	URLs        map[string]TimeMapEntry `json:"urls"`
+	Aliases     map[string]string       `json:"aliases,omitempty"`
+}
+
+// urlKey names the files stored for url under public/: stable, and safe
+// in paths.
+func urlKey(url string) string {
+	sum := sha1.Sum([]byte(url))
+	return hex.EncodeToString(sum[:])[:16]
+}
+
+// timemapName is the file name of url's TimeMap.
+func timemapName(url string) string {
+	return urlKey(url) + ".link"
+}
+
+// publicURI maps a file written under public/ (such as a WARC) to the URL
+// the site serves it at, or "" if it is not under public/.
+func publicURI(siteURL, path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		if wd, err := os.Getwd(); err == nil {
+			if rel, err := filepath.Rel(wd, abs); err == nil {
+				path = rel
+			}
+		}
+	}
+	rest, ok := strings.CutPrefix(filepath.ToSlash(filepath.Clean(path)), "public/")
+	if !ok {
+		return ""
+	}
+	return strings.TrimRight(siteURL, "/") + "/" + rest
+}
+
+// formatTimeMap renders mementos (oldest first) as an RFC 7089 TimeMap.
+func formatTimeMap(original, self string, mementos []Memento) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "<%s>;rel=\"original\",\n", original)
+	fmt.Fprintf(&b, "<%s>;rel=\"self\";type=\"application/link-format\"", self)
+	if len(mementos) > 0 {
+		fmt.Fprintf(&b, ";from=\"%s\";until=\"%s\"",
+			mementos[0].Datetime.UTC().Format(http.TimeFormat),
+			mementos[len(mementos)-1].Datetime.UTC().Format(http.TimeFormat))
+	}
+	for i, m := range mementos {
+		rel := "memento"
+		switch {
+		case len(mementos) == 1:
+			rel = "first last memento"
+		case i == 0:
+			rel = "first memento"
+		case i == len(mementos)-1:
+			rel = "last memento"
+		}
+		fmt.Fprintf(&b, ",\n<%s>;rel=\"%s\";datetime=\"%s\"", m.URI, rel, m.Datetime.UTC().Format(http.TimeFormat))
+	}
+	b.WriteString("\n")
+	return b.String()
+}
+
+// runTimemap is the "timemap" mode.
+func runTimemap(ctx context.Context, cfg config) {
+	set, err := gatherRefs(cfg)
+	if err != nil {
+		log.Fatalf("Failed to collect URLs: %v", err)
+	}
+	ledger, err := openLedger(cfg.LedgerPath)
+	if err != nil {
+		log.Fatalf("Failed to open ledger: %v", err)
+	}
+	defer ledger.Close()
+	if err := os.MkdirAll(cfg.TimeMapDir, 0755); err != nil {
+		log.Fatalf("TimeMap dir error: %v", err)
+	}
+	// With an empty site URL publicURI gives the path the site serves it at.
+	sitePath := publicURI("", cfg.TimeMapDir)
+	if sitePath == "" {
+		log.Fatalf("-timemapDir %s is not under public/, so the site cannot serve it", cfg.TimeMapDir)
+	}
+
+	var lookup *waybackLookup
+	if cfg.CDX {
+		lookup = newWaybackLookup(defaultHTTPClient(cfg.UserAgent), cfg.WaybackAPI)
+	}
+
+	index := TimeMapIndex{
+		GeneratedAt: time.Now().UTC().Format(time.RFC3339),
+		URLs:        make(map[string]TimeMapEntry),
+		Aliases:     make(map[string]string),
+	}
+	written := make(map[string]bool)
+	for _, u := range uniqueURLs(set.Refs) {
+		if ctx.Err() != nil {
+			break
+		}
+		mementos, err := ledger.Mementos(u)
+		if err != nil {
+			log.Printf("Ledger read error %s: %v", u, err)
+			continue
+		}
+		if lookup != nil {
+			caps, err := lookup.Captures(ctx, u)
+			if err != nil {
+				log.Printf("CDX lookup %s: %v", u, err)
+			}
+			for _, c := range caps {
+				mementos = append(mementos, Memento{Service: "archive.org", URI: c.URL, Datetime: c.Timestamp})
+			}
+		}
+		mementos = resolveMementos(cfg.SiteURL, mementos)
+		if len(mementos) == 0 {
+			continue
+		}
+
+		name := timemapName(u)
+		self := strings.TrimRight(cfg.SiteURL, "/") + sitePath + "/" + name
+		if err := os.WriteFile(filepath.Join(cfg.TimeMapDir, name), []byte(formatTimeMap(u, self, mementos)), 0644); err != nil {
+			log.Printf("TimeMap write error %s: %v", u, err)
+			continue
+		}
+		written[name] = true
+
+		entry := TimeMapEntry{
+			TimeMap: sitePath + "/" + name,
+			First:   mementos[0].URI,
+			Last:    mementos[len(mementos)-1].URI,
+		}
+		for _, m := range mementos {
+			entry.Mementos = append(entry.Mementos, IndexMemento{URI: m.URI, Datetime: m.Datetime.UTC().Format(time.RFC3339), Service: m.Service})
+		}
+		index.URLs[u] = entry
+	}
+	for _, r := range set.Refs {
+		if _, ok := index.URLs[r.URL]; ok && r.Original != "" && r.Original != r.URL {
+			index.Aliases[r.Original] = r.URL
+		}
+	}
+
+	// Drop TimeMaps for URLs no longer cited or archived, unless interrupted.
+	if ctx.Err() == nil {
+		old, _ := filepath.Glob(filepath.Join(cfg.TimeMapDir, "*.link"))
+		for _, f := range old {
+			if !written[filepath.Base(f)] {
+				os.Remove(f)
+			}
+		}
+	}
+
+	data, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		log.Fatalf("Index encode error: %v", err)
+	}
+	indexPath := filepath.Join(cfg.TimeMapDir, "index.json")
+	if err := os.WriteFile(indexPath, append(data, '\n'), 0644); err != nil {
+		log.Fatalf("Index write error: %v", err)
+	}
+	fmt.Printf("Wrote %d TimeMaps to %s. Index: %s\n", len(written), cfg.TimeMapDir, indexPath)
+}
+
+// resolveMementos turns local WARC paths into site URLs, drops duplicates
+// and undated or unservable entries, and sorts oldest first.
+func resolveMementos(siteURL string, mementos []Memento) []Memento {
+	var out []Memento
+	seen := make(map[string]bool)
+	for _, m := range mementos {
+		if m.Datetime.IsZero() {
+			continue
+		}
+		if !strings.Contains(m.URI, "://") {
+			m.URI = publicURI(siteURL, m.URI)
+			if m.URI == "" {
+				continue
+			}
+		}
+		if seen[m.URI] {
+			continue
+		}
+		seen[m.URI] = true
+		out = append(out, m)
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Datetime.Before(out[j].Datetime) })
+	return out
+}
@@ -0,0 +1,291 @@
+// -----------------------------------------------------------------------------
+// File:          url-archiver-warc.go
+// Description:   Local fetch-to-WARC backend for URLArchiverV1. Writes WARC 1.1
+//                files with one gzip member per record (.warc.gz) so standard
+//                tools (warcio, pywb, replayweb.page) can read them directly.
+// Author:        Kris Yotam
+// License:       CC-0
+// -----------------------------------------------------------------------------
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxWARCPayload caps how much of a response body is captured; longer bodies
+// are cut off and marked with WARC-Truncated: length.
+const maxWARCPayload = 64 << 20
+
+// warcArchiver fetches each URL itself and appends the request/response pair
+// to a WARC file, giving us copies independent of any third-party archive.
+type warcArchiver struct {
+	client     *http.Client
+	dir        string
+	robots     *robotsCache
+	hosts      *hostLimiter // paces redirect hops; the first fetch is paced by guardedArchiver
+	maxPayload int
+
+	mu   sync.Mutex
+	file *os.File
+	path string
+}
+
+// warcRecord is one WARC record before serialisation. Fields holds the named
+// headers in write order; WARC/1.1, Content-Length and the digests are added
+// by writeRecord.
+type warcRecord struct {
+	Fields [][2]string
+	Block  []byte
+}
+
+func newWARCArchiver(client *http.Client, dir string, robots *robotsCache, hosts *hostLimiter) *warcArchiver {
+	return &warcArchiver{client: client, dir: dir, robots: robots, hosts: hosts, maxPayload: maxWARCPayload}
+}
+
+func (w *warcArchiver) Name() string { return "warc" }
+
+func (w *warcArchiver) Archive(ctx context.Context, target string) ArchiveResult {
+	res := ArchiveResult{URL: target, Service: w.Name()}
+	// Redirects are followed by hand, as probe does, so every hop gets its
+	// own request/response pair and the cited URL has a record of its own.
+	// Each hop may lead to another host, so each is checked against
+	// robots.txt and the host limiter like a fetch of its own.
+	client := noRedirectClient(w.client)
+	at := time.Now().UTC()
+	var records []warcRecord
+	var resp *http.Response
+	current := target
+	for hop := 0; ; hop++ {
+		if !w.robots.Allowed(ctx, current) {
+			res.Error = errRobotsDisallowed
+			return res
+		}
+		if hop > 0 {
+			if err := w.hosts.Wait(ctx, current); err != nil {
+				res.Error = err
+				return res
+			}
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, current, nil)
+		if err != nil {
+			res.Error = err
+			return res
+		}
+		// Ask for the identity encoding so the captured payload is the bytes
+		// the server actually sent rather than Go's decompressed copy.
+		req.Header.Set("Accept-Encoding", "identity")
+		resp, err = client.Do(req)
+		if err != nil {
+			res.Error = err
+			return res
+		}
+		body, err := io.ReadAll(io.LimitReader(resp.Body, int64(w.maxPayload)+1))
+		resp.Body.Close()
+		if err != nil {
+			res.Error = fmt.Errorf("warc: read body: %w", err)
+			return res
+		}
+		res.HTTPStatus = resp.StatusCode
+		records = append(records, captureRecords(at, current, resp, body, w.maxPayload)...)
+
+		loc := resp.Header.Get("Location")
+		if resp.StatusCode < 300 || resp.StatusCode >= 400 || loc == "" {
+			break
+		}
+		if hop >= maxRedirects {
+			res.Error = fmt.Errorf("warc: more than %d redirects", maxRedirects)
+			return res
+		}
+		next, err := req.URL.Parse(loc)
+		if err != nil {
+			res.Error = fmt.Errorf("warc: bad redirect %q: %w", loc, err)
+			return res
+		}
+		current = next.String()
+	}
+
+	path, err := w.write(at, records...)
+	if err != nil {
+		res.Error = err
+		return res
+	}
+	// An error page is kept in the WARC but is not a snapshot of the page.
+	if resp.StatusCode >= 400 {
+		res.Error = statusError("warc", resp)
+		return res
+	}
+	res.Archived = true
+	res.Verified = resp.StatusCode < 300
+	res.SnapshotURL = path
+	res.SnapshotAt = at
+	return res
+}
+
+// captureRecords builds the response record for one exchange with uri and
+// the request record pointing at it. A body longer than limit is cut to limit
+// bytes and marked with WARC-Truncated.
+func captureRecords(at time.Time, uri string, resp *http.Response, body []byte, limit int) []warcRecord {
+	truncated := len(body) > limit
+	if truncated {
+		body = body[:limit]
+	}
+	respID := "<urn:uuid:" + newUUID() + ">"
+	respFields := [][2]string{
+		{"WARC-Type", "response"},
+		{"WARC-Record-ID", respID},
+		{"WARC-Date", at.Format(time.RFC3339)},
+		{"WARC-Target-URI", uri},
+		{"Content-Type", "application/http; msgtype=response"},
+		{"WARC-Payload-Digest", warcDigest(body)},
+	}
+	if truncated {
+		respFields = append(respFields, [2]string{"WARC-Truncated", "length"})
+	}
+	return []warcRecord{
+		{Fields: respFields, Block: httpResponseBlock(resp, body, truncated)},
+		{Fields: [][2]string{
+			{"WARC-Type", "request"},
+			{"WARC-Record-ID", "<urn:uuid:" + newUUID() + ">"},
+			{"WARC-Date", at.Format(time.RFC3339)},
+			{"WARC-Target-URI", uri},
+			{"WARC-Concurrent-To", respID},
+			{"Content-Type", "application/http; msgtype=request"},
+		}, Block: httpRequestBlock(resp.Request)},
+	}
+}
+
+// write appends records to the run's WARC file, opening it with a warcinfo
+// record on first use. Records from one capture are written under a single
+// lock so request/response pairs stay adjacent.
+func (w *warcArchiver) write(at time.Time, records ...warcRecord) (string, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.file == nil {
+		if err := w.open(at); err != nil {
+			return "", err
+		}
+	}
+	for _, r := range records {
+		if err := writeWARCRecord(w.file, r); err != nil {
+			return "", err
+		}
+	}
+	return w.path, nil
+}
+
+func (w *warcArchiver) open(at time.Time) error {
+	if err := os.MkdirAll(w.dir, 0755); err != nil {
+		return err
+	}
+	name := "urlarchiver-" + at.Format("20060102150405") + ".warc.gz"
+	w.path = filepath.Join(w.dir, name)
+	f, err := os.OpenFile(w.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	w.file = f
+	info := []byte("software: URLArchiverV1 (krisyotam.com)\r\n" +
+		"format: WARC File Format 1.1\r\n" +
+		"conformsTo: http://iipc.github.io/warc-specifications/specifications/warc-format/warc-1.1/\r\n")
+	return writeWARCRecord(w.file, warcRecord{
+		Fields: [][2]string{
+			{"WARC-Type", "warcinfo"},
+			{"WARC-Record-ID", "<urn:uuid:" + newUUID() + ">"},
+			{"WARC-Date", at.Format(time.RFC3339)},
+			{"WARC-Filename", name},
+			{"Content-Type", "application/warc-fields"},
+		},
+		Block: info,
+	})
+}
+
+// Close flushes and closes the WARC file if one was opened.
+func (w *warcArchiver) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.file == nil {
+		return nil
+	}
+	err := w.file.Close()
+	w.file = nil
+	return err
+}
+
+// writeWARCRecord serialises r as its own gzip member so readers can seek to
+// any record offset.
+func writeWARCRecord(dst io.Writer, r warcRecord) error {
+	var buf bytes.Buffer
+	buf.WriteString("WARC/1.1\r\n")
+	for _, f := range r.Fields {
+		fmt.Fprintf(&buf, "%s: %s\r\n", f[0], f[1])
+	}
+	fmt.Fprintf(&buf, "WARC-Block-Digest: %s\r\n", warcDigest(r.Block))
+	fmt.Fprintf(&buf, "Content-Length: %d\r\n\r\n", len(r.Block))
+	buf.Write(r.Block)
+	buf.WriteString("\r\n\r\n")
+
+	zw := gzip.NewWriter(dst)
+	if _, err := zw.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// httpResponseBlock rebuilds the status line, headers and body of resp.
+func httpResponseBlock(resp *http.Response, body []byte, truncated bool) []byte {
+	header := resp.Header
+	if truncated {
+		// Content-Length must match the bytes the block holds or replay
+		// tools read past the record; the server's figure is kept aside.
+		header = header.Clone()
+		if n := header.Get("Content-Length"); n != "" {
+			header.Set("X-Original-Content-Length", n)
+		}
+		header.Set("Content-Length", strconv.Itoa(len(body)))
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s %s\r\n", resp.Proto, resp.Status)
+	header.Write(&buf)
+	buf.WriteString("\r\n")
+	buf.Write(body)
+	return buf.Bytes()
+}
+
+// httpRequestBlock rebuilds the request line and headers of req.
+func httpRequestBlock(req *http.Request) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s %s HTTP/1.1\r\n", req.Method, req.URL.RequestURI())
+	fmt.Fprintf(&buf, "Host: %s\r\n", req.URL.Host)
+	req.Header.Write(&buf)
+	buf.WriteString("\r\n")
+	return buf.Bytes()
+}
+
+// warcDigest returns the labelled SHA-1 digest used by WARC-*-Digest headers.
+func warcDigest(b []byte) string {
+	sum := sha1.Sum(b)
+	return "sha1:" + base32.StdEncoding.EncodeToString(sum[:])
+}
+
+// newUUID returns a random (version 4) UUID for WARC-Record-ID.
+func newUUID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"os"
+	"testing"
+	"time"
+)
+
+// readWARC returns the headers of every record in a .warc.gz, one gzip
+// member at a time.
+func readWARC(t *testing.T, path string) []textproto.MIMEHeader {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	br := bufio.NewReader(f)
+	zr, err := gzip.NewReader(br)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out []textproto.MIMEHeader
+	for {
+		zr.Multistream(false)
+		member, err := io.ReadAll(zr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tp := textproto.NewReader(bufio.NewReader(bytes.NewReader(member)))
+		if line, err := tp.ReadLine(); err != nil || line != "WARC/1.1" {
+			t.Fatalf("record starts with %q (%v)", line, err)
+		}
+		h, err := tp.ReadMIMEHeader()
+		if err != nil {
+			t.Fatal(err)
+		}
+		out = append(out, h)
+		if err := zr.Reset(br); err == io.EOF {
+			return out
+		} else if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestWARCArchiveRecordsRedirectHops(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/start", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/final", http.StatusMovedPermanently)
+	})
+	mux.HandleFunc("/final", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "the essay")
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	w := newWARCArchiver(srv.Client(), t.TempDir(), nil, nil)
+	res := w.Archive(context.Background(), srv.URL+"/start")
+	w.Close()
+	if res.Error != nil || !res.Archived {
+		t.Fatalf("archive failed: %v", res.Error)
+	}
+	if res.HTTPStatus != http.StatusOK {
+		t.Errorf("status = %d, want 200", res.HTTPStatus)
+	}
+
+	records := readWARC(t, res.SnapshotURL)
+	if len(records) != 5 {
+		t.Fatalf("got %d records, want warcinfo plus two pairs", len(records))
+	}
+	if got := records[0].Get("Warc-Type"); got != "warcinfo" {
+		t.Errorf("first record is %q, want warcinfo", got)
+	}
+	want := []struct{ kind, uri string }{
+		{"response", srv.URL + "/start"},
+		{"request", srv.URL + "/start"},
+		{"response", srv.URL + "/final"},
+		{"request", srv.URL + "/final"},
+	}
+	for i, w := range want {
+		r := records[i+1]
+		if r.Get("Warc-Type") != w.kind || r.Get("Warc-Target-Uri") != w.uri {
+			t.Errorf("record %d = %s %s, want %s %s", i+1, r.Get("Warc-Type"), r.Get("Warc-Target-Uri"), w.kind, w.uri)
+		}
+	}
+	for _, i := range []int{1, 3} {
+		if records[i+1].Get("Warc-Concurrent-To") != records[i].Get("Warc-Record-Id") {
+			t.Errorf("request %d is not concurrent to its response", i+1)
+		}
+	}
+	if got, want := records[3].Get("Warc-Payload-Digest"), warcDigest([]byte("the essay")); got != want {
+		t.Errorf("payload digest = %q, want %q", got, want)
+	}
+}
+
+func TestWARCArchiveErrorStatus(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "gone", http.StatusNotFound)
+	}))
+	defer srv.Close()
+
+	w := newWARCArchiver(srv.Client(), t.TempDir(), nil, nil)
+	res := w.Archive(context.Background(), srv.URL+"/missing")
+	w.Close()
+	if res.Archived {
+		t.Error("a 404 should not count as archived")
+	}
+	var se *httpStatusError
+	if !errors.As(res.Error, &se) || se.Status != http.StatusNotFound {
+		t.Fatalf("err = %v, want a 404 status error", res.Error)
+	}
+	// The error page is still kept in the WARC.
+	if w.path == "" {
+		t.Fatal("no WARC file was written")
+	}
+	records := readWARC(t, w.path)
+	if len(records) != 3 || records[1].Get("Warc-Target-Uri") != srv.URL+"/missing" {
+		t.Errorf("got %d records, want warcinfo plus the 404 pair", len(records))
+	}
+}
+
+func TestWARCArchiveChecksRobotsOnEachHop(t *testing.T) {
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/robots.txt" {
+			io.WriteString(w, "User-agent: *\nDisallow: /\n")
+			return
+		}
+		t.Errorf("fetched %s despite robots.txt", r.URL.Path)
+	}))
+	defer other.Close()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/start" {
+			http.Redirect(w, r, other.URL+"/essay", http.StatusFound)
+		}
+	}))
+	defer srv.Close()
+
+	cfg := config{UserAgent: "URLArchiverV1/test", Robots: true}
+	hosts := newHostLimiter(0)
+	w := newWARCArchiver(srv.Client(), t.TempDir(), newRobotsCache(cfg, srv.Client(), hosts), hosts)
+	res := w.Archive(context.Background(), srv.URL+"/start")
+	w.Close()
+	if !errors.Is(res.Error, errRobotsDisallowed) || res.Archived {
+		t.Errorf("err = %v, archived = %v; want the disallowed hop to stop the capture", res.Error, res.Archived)
+	}
+}
+
+func TestCaptureRecordsTruncatedPayload(t *testing.T) {
+	const target = "https://example.com/essay"
+	req, _ := http.NewRequest(http.MethodGet, target, nil)
+	resp := &http.Response{
+		Proto:   "HTTP/1.1",
+		Status:  "200 OK",
+		Header:  http.Header{"Content-Length": {"11"}, "Content-Type": {"text/plain"}},
+		Request: req,
+	}
+	records := captureRecords(time.Now(), target, resp, []byte("the essay!!"), 4)
+	fields := make(map[string]string)
+	for _, f := range records[0].Fields {
+		fields[f[0]] = f[1]
+	}
+	if fields["WARC-Truncated"] != "length" {
+		t.Error("a cut payload should be marked WARC-Truncated: length")
+	}
+	if want := warcDigest([]byte("the ")); fields["WARC-Payload-Digest"] != want {
+		t.Errorf("payload digest = %q, want the digest of the kept bytes %q", fields["WARC-Payload-Digest"], want)
+	}
+
+	got, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(records[0].Block)), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(got.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "the " || got.ContentLength != 4 {
+		t.Errorf("block body = %q with Content-Length %d, want %q with 4", body, got.ContentLength, "the ")
+	}
+	if n := got.Header.Get("X-Original-Content-Length"); n != "11" {
+		t.Errorf("X-Original-Content-Length = %q, want 11", n)
+	}
+	if resp.Header.Get("Content-Length") != "11" {
+		t.Error("the live response's headers should be left alone")
+	}
+}
@@ -0,0 +1,178 @@
+// -----------------------------------------------------------------------------
+// File:          url-archiver-wayback.go
+// Description:   Wayback Machine lookups for URLArchiverV1: the availability API
+//                for the closest snapshot and the CDX API for the last good
+//                capture before a date. The endpoint is configurable so tests
+//                can point it at a local stub server.
+// Author:        Kris Yotam
+// License:       CC-0
+// -----------------------------------------------------------------------------
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// waybackTimeLayout is the 14-digit timestamp used in Wayback URLs.
+const waybackTimeLayout = "20060102150405"
+
+// Snapshot is one Wayback capture of a URL.
+type Snapshot struct {
+	URL       string // replayable web.archive.org URL
+	Timestamp time.Time
+	Status    int
+}
+
+// waybackLookup queries the availability and CDX APIs under endpoint.
+type waybackLookup struct {
+	client   *http.Client
+	endpoint string // e.g. https://web.archive.org
+}
+
+func newWaybackLookup(client *http.Client, endpoint string) *waybackLookup {
+	return &waybackLookup{client: client, endpoint: endpoint}
+}
+
+// availabilityResponse mirrors /wayback/available.
+type availabilityResponse struct {
+	ArchivedSnapshots struct {
+		Closest *struct {
+			Available bool   `json:"available"`
+			URL       string `json:"url"`
+			Timestamp string `json:"timestamp"`
+			Status    string `json:"status"`
+		} `json:"closest"`
+	} `json:"archived_snapshots"`
+}
+
+// Closest returns the snapshot nearest to at, or nil if none exists.
+func (w *waybackLookup) Closest(ctx context.Context, target string, at time.Time) (*Snapshot, error) {
+	q := url.Values{"url": {target}}
+	if !at.IsZero() {
+		q.Set("timestamp", at.UTC().Format(waybackTimeLayout))
+	}
+	var body availabilityResponse
+	if err := w.getJSON(ctx, w.endpoint+"/wayback/available?"+q.Encode(), &body); err != nil {
+		return nil, err
+	}
+	c := body.ArchivedSnapshots.Closest
+	if c == nil || !c.Available || c.URL == "" {
+		return nil, nil
+	}
+	ts, _ := time.Parse(waybackTimeLayout, c.Timestamp)
+	status, _ := strconv.Atoi(c.Status)
+	// The availability API answers with http:// replay URLs.
+	snapURL := c.URL
+	if rest, ok := strings.CutPrefix(snapURL, "http://web.archive.org/"); ok {
+		snapURL = "https://web.archive.org/" + rest
+	}
+	return &Snapshot{URL: snapURL, Timestamp: ts, Status: status}, nil
+}
+
+// LastGoodBefore uses the CDX API to find the latest 200 capture at or before
+// at (any time if at is zero), or nil if there is none.
+func (w *waybackLookup) LastGoodBefore(ctx context.Context, target string, at time.Time) (*Snapshot, error) {
+	q := url.Values{
+		"url":    {target},
+		"output": {"json"},
+		"filter": {"statuscode:200"},
+		"fl":     {"timestamp,original,statuscode"},
+		"limit":  {"-1"},
+	}
+	if !at.IsZero() {
+		q.Set("to", at.UTC().Format(waybackTimeLayout))
+	}
+	var rows [][]string
+	if err := w.getJSON(ctx, w.endpoint+"/cdx/search/cdx?"+q.Encode(), &rows); err != nil {
+		return nil, err
+	}
+	// The first row is the field header.
+	if len(rows) < 2 || len(rows[len(rows)-1]) < 3 {
+		return nil, nil
+	}
+	last := rows[len(rows)-1]
+	ts, err := time.Parse(waybackTimeLayout, last[0])
+	if err != nil {
+		return nil, fmt.Errorf("cdx: bad timestamp %q", last[0])
+	}
+	status, _ := strconv.Atoi(last[2])
+	return &Snapshot{
+		URL:       "https://web.archive.org/web/" + last[0] + "/" + last[1],
+		Timestamp: ts,
+		Status:    status,
+	}, nil
+}
+
+// Captures lists every 200 capture of target, oldest first, collapsing
+// captures of identical content.
+func (w *waybackLookup) Captures(ctx context.Context, target string) ([]Snapshot, error) {
+	q := url.Values{
+		"url":      {target},
+		"output":   {"json"},
+		"filter":   {"statuscode:200"},
+		"fl":       {"timestamp,original,statuscode"},
+		"collapse": {"digest"},
+	}
+	var rows [][]string
+	if err := w.getJSON(ctx, w.endpoint+"/cdx/search/cdx?"+q.Encode(), &rows); err != nil {
+		return nil, err
+	}
+	var snaps []Snapshot
+	for i, row := range rows {
+		if i == 0 || len(row) < 3 {
+			continue // field header
+		}
+		ts, err := time.Parse(waybackTimeLayout, row[0])
+		if err != nil {
+			continue
+		}
+		status, _ := strconv.Atoi(row[2])
+		snaps = append(snaps, Snapshot{URL: "https://web.archive.org/web/" + row[0] + "/" + row[1], Timestamp: ts, Status: status})
+	}
+	return snaps, nil
+}
+
+// BestBefore prefers the availability API's closest capture when it is a
+// good one taken no later than at, and otherwise asks CDX for the last good
+// capture before at.
+func (w *waybackLookup) BestBefore(ctx context.Context, target string, at time.Time) (*Snapshot, error) {
+	snap, err := w.Closest(ctx, target, at)
+	if err != nil {
+		return nil, err
+	}
+	if snap != nil && snap.Status == http.StatusOK && (at.IsZero() || !snap.Timestamp.After(at)) {
+		return snap, nil
+	}
+	return w.LastGoodBefore(ctx, target, at)
+}
+
+func (w *waybackLookup) getJSON(ctx context.Context, u string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return statusError("wayback lookup", resp)
+	}
+	// CDX answers an empty body, not [], when nothing matches.
+	dec := json.NewDecoder(resp.Body)
+	if err := dec.Decode(v); err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	return nil
+}
@@ -3,157 +3,556 @@
 // Description:   Scan MDX and JSON files for URLs and archive them via multiple archival services
 // Author:        Kris Yotam
 // Created:       2025-04-23
-// Last Modified: 2025-04-23 17:00:00 (America/Chicago)
+// Last Modified: 2026-10-17 10:00:00 (America/Chicago)
 // License:       CC-0
 //
 // Dependencies:
 //   • Standard library: fmt, os, io/fs, path/filepath, encoding/json, net/http, context, time, sync
 //   • Third-party modules:
+//       – github.com/mattn/go-sqlite3 v1.14.34   // archive ledger
 //       – github.com/yuin/goldmark v1.5.4        // Optional: markdown to HTML if needed
 //       – github.com/PuerkitoBio/goquery v1.8.0  // Optional: HTML querying
 //       – golang.org/x/sync/errgroup v0.1.0     // concurrency helpers
 //
 // Usage:
-//   $ go build -o bin/urlarchiverv1 ./cmd/urlarchiverv1
-//   $ ./bin/urlarchiverv1 -contentDir=app/blog -dataDir=data/feed.json -report=archives_report.txt
+//   $ go build -o bin/urlarchiverv1 ./public/scripts/doc
+//   $ ./bin/urlarchiverv1 [mode] [flags]
+//   $ ./bin/urlarchiverv1 -type=essays,notes -state=active -report=archives_report.txt
+//   $ ./bin/urlarchiverv1 check -report=link_check.txt
+//   $ ./bin/urlarchiverv1 -since=HEAD~1        // e.g. from a post-commit hook
+//   $ ./bin/urlarchiverv1 rewrite -confirmAfter=3 -apply
+//   $ ./bin/urlarchiverv1 serve -services=archive.org,warc -concurrency=4
+//   $ ./bin/urlarchiverv1 links -since=HEAD -report=internal_links.txt
+//   $ ./bin/urlarchiverv1 coverage -type=essays,notes,papers -report=coverage.txt
+//   $ ./bin/urlarchiverv1 -services=archive.org -record=public/scripts/doc/testdata/cassettes/new.json
+//   $ go test ./public/scripts/doc   // offline: replays testdata/cassettes
+//   $ ./bin/urlarchiverv1 graph -graph=link_graph && dot -Tsvg link_graph.dot -o link_graph.svg
+//
+// Modes:
+//   archive        // (default) submit cited URLs to the selected archival services
+//   check          // probe cited URLs and report dead links with the slugs citing them
+//   rewrite        // map confirmed-dead citations to Wayback snapshots; -apply edits the sources
+//   timemap        // write RFC 7089 TimeMaps and a JSON index of every cited URL's snapshots
+//   text           // store readable text snapshots of cited pages that have none yet
+//   serve          // run as a daemon: HTTP API plus a persistent job queue (see url-archiver-daemon.go)
+//   links          // validate links to our own pages against content.db and the site's routes
+//   graph          // export the page -> domain / page -> page link graph as JSON and GraphViz DOT
+//   mirror         // download cited PDFs and other documents and register them in storage.db
+//   coverage       // write each page's share of archived outbound URLs to content.db (archive_coverage)
 //
 // Flags:
-//   -contentDir    string   // root directory of MDX/JSON files (e.g., "app/blog")
-//   -dataFeed      string   // path to feed.json containing slugs
+//   -contentDir    string   // root of MDX/JSON files, one subdirectory per type (default src/content)
+//   -contentDB     string   // content.db listing every type and slug (default public/data/content.db)
+//   -type          string   // comma-separated content types to scan, e.g. essays,papers (default all)
+//   -state         string   // comma-separated content states to scan, e.g. active (default all)
+//   -since         string   // only scan MDX/JSON files changed since this git ref, e.g. HEAD~1 or origin/main
 //   -report        string   // output report file for archived URLs
+//   -format        string   // report format: text, json, jsonl, csv, html (default from the -report extension)
 //   -concurrency   int      // max parallel HTTP/archive requests (default 20)
+//   -ledger        string   // SQLite ledger of past submissions (default public/data/archive.db)
+//   -maxAge        duration // resubmit URLs whose last snapshot is older than this (default 720h)
+//   -services      string   // comma-separated backends: archive.org, archive.today, ghostarchive, warc
+//   -retries       int      // max attempts per URL and service, with jittered exponential backoff (default 4)
+//   -serviceRate   float    // requests/second allowed per archival service (default 0.2)
+//   -hostRate      float    // requests/second allowed per target host across services (default 1)
+//   -breakerThreshold int   // consecutive failures before a service is paused (default 5)
+//   -breakerCooldown  duration // how long a tripped service stays paused (default 5m)
+//   -resume        bool     // finish the jobs left over from the last interrupted run
+//   -normalizeRules string  // JSON per-domain URL normalisation rules (see url-archiver-normalize.go)
+//   -policy        string   // JSON domain/path allow/deny/always rules (see url-archiver-policy.go)
+//   -warcDir       string   // where the warc backend writes WARC 1.1 .warc.gz files (default public/archive/warc)
+//   -confirmAfter  int      // rewrite: consecutive broken checks before a link counts as dead (default 2)
+//   -rewriteMap    string   // rewrite: JSON map of dead URL -> snapshot (default archive_rewrites.json)
+//   -apply         bool     // rewrite: edit page.mdx / bibliography.json in place instead of printing a diff
+//   -timemapDir    string   // timemap: where TimeMaps and index.json go, under public/ (default public/archive/timemap)
+//   -siteURL       string   // public base URL of the site (default https://krisyotam.com)
+//   -cdx           bool     // timemap: also merge every Wayback capture listed by the CDX API
+//   -graph         string   // graph: output path without extension, writes .json and .dot (default link_graph)
+//   -appDir        string   // links: App Router tree whose pages are valid link targets (default src/app)
+//   -publicDir     string   // links: directory that serves static files like /images/x.png (default public)
+//   -listen        string   // serve: address of the HTTP API (default 127.0.0.1:8089)
+//   -textDir       string   // readable Markdown copies of cited pages plus index.json, under public/ (default public/archive/text; empty = off)
+//   -mirrorDir     string   // local mirror of cited documents, synced by sync.sh (default mirror/docs; empty = off)
+//   -mirrorBucket  string   // storage.db bucket mirrored documents are registered in (default doc)
+//   -mirrorMaxMB   int      // largest document to mirror, in MiB (default 50)
+//   -storageDB     string   // object storage catalog with buckets/objects tables (default public/data/storage.db)
+//   -userAgent     string   // User-Agent for every request; its product token selects robots.txt groups (default URLArchiverV1/1.0 (+https://krisyotam.com))
+//   -robots        bool     // honor robots.txt and Crawl-delay for direct fetches: check, text, warc, mirror (default true)
+//   -record        string   // save every HTTP exchange to a JSON cassette for offline tests (see url-archiver-cassette.go)
+//   -drift         string   // fingerprint page text at archive time for: citations (default), all, off
+//   -driftThreshold float   // check: flag pages less similar than this to their archived text (default 0.8)
+//   -waybackAPI    string   // Wayback Save Page Now, availability and CDX endpoint (default https://web.archive.org)
 // -----------------------------------------------------------------------------
 
 package main
 
 import (
 	"context"
-	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"log"
-	"net/http"
 	"os"
-	"path/filepath"
-	"regexp"
+	"os/signal"
+	"sort"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"golang.org/x/sync/errgroup"
 )
 
-type FeedEntry struct {
-	Slug string `json:"slug"`
+// SourceFile is one file to scan and the content item it belongs to.
+type SourceFile struct {
+	Path string
+	Type string
+	Slug string
 }
 
 type ArchiveResult struct {
-	URL      string
-	Service  string
-	Archived bool
-	Error    error
+	URL         string
+	Service     string
+	Archived    bool
+	SnapshotURL string
+	SnapshotAt  time.Time // memento timestamp of SnapshotURL, when the service reports one
+	Verified    bool      // the snapshot is known to hold a 2xx capture of URL
+	HTTPStatus  int       // status of the last submission response, 0 if none
+	Attempts    int
+	Duration    time.Duration // time spent in requests, summed over attempts
+	Error       error
+}
+
+// config holds every command-line setting for one invocation.
+type config struct {
+	ContentDir       string
+	ContentDB        string
+	Types            string
+	States           string
+	Since            string
+	ReportPath       string
+	ReportFormat     string
+	LedgerPath       string
+	Services         string
+	WARCDir          string
+	Concurrency      int
+	Retries          int
+	BreakerThreshold int
+	ServiceRate      float64
+	HostRate         float64
+	MaxAge           time.Duration
+	BreakerCooldown  time.Duration
+	NormalizeRules   string
+	PolicyPath       string
+	Resume           bool
+	ConfirmAfter     int
+	RewriteMap       string
+	Apply            bool
+	WaybackAPI       string
+	TimeMapDir       string
+	SiteURL          string
+	CDX              bool
+	GraphPath        string
+	AppDir           string
+	Listen           string
+	TextDir          string
+	MirrorDir        string
+	MirrorBucket     string
+	MirrorMaxMB      int64
+	StorageDB        string
+	UserAgent        string
+	Robots           bool
+	Record           string
+	PublicDir        string
+	Drift            string
+	DriftThreshold   float64
 }
 
 func main() {
-	var contentDir, feedPath, reportPath string
-	var concurrency int
-	flag.StringVar(&contentDir, "contentDir", "app/blog", "root directory of MDX/JSON files")
-	flag.StringVar(&feedPath, "dataFeed", "data/essays/feed.json", "path to feed.json containing slugs")
-	flag.StringVar(&reportPath, "report", "archives_report.txt", "output report file")
-	flag.IntVar(&concurrency, "concurrency", 20, "max parallel requests")
-	flag.Parse()
-
-	slugs, err := loadSlugs(feedPath)
-	if err != nil {
-		log.Fatalf("Failed to load feed: %v", err)
+	var cfg config
+	flag.StringVar(&cfg.ContentDir, "contentDir", "src/content", "root directory of MDX/JSON files, one subdirectory per content type")
+	flag.StringVar(&cfg.ContentDB, "contentDB", "public/data/content.db", "SQLite database listing content types and slugs")
+	flag.StringVar(&cfg.Types, "type", "", "comma-separated content types to scan (default all)")
+	flag.StringVar(&cfg.States, "state", "", "comma-separated content states to scan, e.g. active,hidden (default all)")
+	flag.StringVar(&cfg.Since, "since", "", "only scan files added or modified since this git ref")
+	flag.StringVar(&cfg.ReportPath, "report", "archives_report.txt", "output report file")
+	flag.StringVar(&cfg.ReportFormat, "format", "", "report format: text, json, jsonl, csv or html (default from -report extension)")
+	flag.IntVar(&cfg.Concurrency, "concurrency", 20, "max parallel requests")
+	flag.StringVar(&cfg.LedgerPath, "ledger", "public/data/archive.db", "SQLite ledger of past submissions")
+	flag.DurationVar(&cfg.MaxAge, "maxAge", 30*24*time.Hour, "resubmit URLs whose last snapshot is older than this (0 = always)")
+	flag.StringVar(&cfg.Services, "services", "archive.org", "comma-separated archival services ("+strings.Join(registeredServices(), ", ")+")")
+	flag.StringVar(&cfg.WARCDir, "warcDir", "public/archive/warc", "output directory for the warc service")
+	flag.IntVar(&cfg.Retries, "retries", 4, "max attempts per URL and service")
+	flag.Float64Var(&cfg.ServiceRate, "serviceRate", 0.2, "requests/second per archival service (0 = unlimited)")
+	flag.Float64Var(&cfg.HostRate, "hostRate", 1, "requests/second per target host (0 = unlimited)")
+	flag.IntVar(&cfg.BreakerThreshold, "breakerThreshold", 5, "consecutive failures before a service is paused (0 = never)")
+	flag.DurationVar(&cfg.BreakerCooldown, "breakerCooldown", 5*time.Minute, "how long a paused service stays paused")
+	flag.StringVar(&cfg.NormalizeRules, "normalizeRules", "", "JSON file of per-domain URL normalisation rules")
+	flag.StringVar(&cfg.PolicyPath, "policy", "", "JSON allow/deny policy deciding which URLs may be submitted")
+	flag.BoolVar(&cfg.Resume, "resume", false, "finish the jobs left over from the last interrupted run")
+	flag.IntVar(&cfg.ConfirmAfter, "confirmAfter", 2, "consecutive broken checks before rewrite treats a link as dead")
+	flag.StringVar(&cfg.RewriteMap, "rewriteMap", "archive_rewrites.json", "output JSON map of dead URLs to snapshots")
+	flag.BoolVar(&cfg.Apply, "apply", false, "rewrite source files in place instead of printing a diff")
+	flag.StringVar(&cfg.TimeMapDir, "timemapDir", "public/archive/timemap", "timemap: output directory for TimeMaps and index.json (under public/)")
+	flag.StringVar(&cfg.SiteURL, "siteURL", "https://krisyotam.com", "public base URL of the site")
+	flag.BoolVar(&cfg.CDX, "cdx", false, "timemap: also list every Wayback capture from the CDX API")
+	flag.StringVar(&cfg.GraphPath, "graph", "link_graph", "graph: output path without extension; writes .json and .dot")
+	flag.StringVar(&cfg.AppDir, "appDir", "src/app", "links: Next.js App Router directory whose pages are valid link targets")
+	flag.StringVar(&cfg.PublicDir, "publicDir", "public", "links: directory serving static files such as /images/...")
+	flag.StringVar(&cfg.Listen, "listen", "127.0.0.1:8089", "serve: address for the HTTP API")
+	flag.StringVar(&cfg.TextDir, "textDir", "public/archive/text", "readable Markdown copies of archived pages, under public/ (empty = off)")
+	flag.StringVar(&cfg.MirrorDir, "mirrorDir", "mirror/docs", "local mirror of cited PDFs and other documents (empty = off)")
+	flag.StringVar(&cfg.MirrorBucket, "mirrorBucket", "doc", "storage.db bucket that mirrored documents are registered in")
+	flag.Int64Var(&cfg.MirrorMaxMB, "mirrorMaxMB", 50, "largest document to mirror, in MiB")
+	flag.StringVar(&cfg.StorageDB, "storageDB", "public/data/storage.db", "object storage catalog (buckets and objects tables)")
+	flag.StringVar(&cfg.UserAgent, "userAgent", "URLArchiverV1/1.0 (+https://krisyotam.com)", "User-Agent sent with every request; its first word is the robots.txt product token")
+	flag.BoolVar(&cfg.Robots, "robots", true, "honor robots.txt and Crawl-delay when fetching pages directly")
+	flag.StringVar(&cfg.Record, "record", "", "save every HTTP request and response to this JSON cassette, for test fixtures")
+	flag.StringVar(&cfg.Drift, "drift", driftCitations, "fingerprint cited pages for drift detection: citations, all or off")
+	flag.Float64Var(&cfg.DriftThreshold, "driftThreshold", 0.8, "check flags pages whose similarity to the archived text falls below this")
+	flag.StringVar(&cfg.WaybackAPI, "waybackAPI", "https://web.archive.org", "Wayback Save Page Now, availability and CDX endpoint")
+	mode := "archive"
+	args := os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		mode, args = args[0], args[1:]
 	}
+	flag.CommandLine.Parse(args)
 
-	// Collect files to scan
-	paths := collectPaths(contentDir, slugs)
+	// First Ctrl-C cancels in-flight requests and flushes what we have; a
+	// second one falls through to the default handler and exits at once.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
 
-	// Extract URLs
-	urls := extractURLs(paths)
+	if cfg.Drift != driftCitations && cfg.Drift != driftAll && cfg.Drift != driftOff {
+		fmt.Fprintf(os.Stderr, "Invalid -drift %q (want citations, all or off)\n", cfg.Drift)
+		os.Exit(2)
+	}
 
-	// Archive URLs
-	results := archiveURLs(urls, concurrency)
+	if cfg.Record != "" {
+		rec := newCassetteRecorder(httpTransport)
+		httpTransport = rec
+		defer func() {
+			if err := rec.Save(cfg.Record); err != nil {
+				log.Printf("Cassette write error: %v", err)
+			}
+		}()
+	}
 
-	// Write report
-	writeReport(reportPath, results)
-	fmt.Printf("Archive run complete. Report: %s\n", reportPath)
+	switch mode {
+	case "archive":
+		runArchive(ctx, cfg)
+	case "check":
+		runCheck(ctx, cfg)
+	case "rewrite":
+		runRewrite(ctx, cfg)
+	case "timemap":
+		runTimemap(ctx, cfg)
+	case "text":
+		runText(ctx, cfg)
+	case "serve":
+		runServe(ctx, cfg)
+	case "links":
+		runLinks(cfg)
+	case "graph":
+		runGraph(cfg)
+	case "mirror":
+		runMirror(ctx, cfg)
+	case "coverage":
+		runCoverage(cfg)
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown mode %q (want archive, check, rewrite, timemap, text, serve, links, graph, mirror or coverage)\n", mode)
+		flag.Usage()
+		os.Exit(2)
+	}
 }
 
-func loadSlugs(feedPath string) ([]string, error) {
-	data, err := os.ReadFile(feedPath)
+// refSet is what gatherRefs found: the files it scanned, the references the
+// policy lets through, the ones it refused, and the URLs it wants archived
+// on every run.
+type refSet struct {
+	Files    []SourceFile
+	Refs     []URLRef
+	Excluded []Exclusion
+	Always   map[string]bool
+}
+
+// contentFiles lists the content selected by -type and -state and the
+// source files found for it, narrowed to those changed since -since.
+func contentFiles(cfg config) ([]ContentItem, []SourceFile, error) {
+	items, err := loadContent(cfg.ContentDB, splitList(cfg.Types), splitList(cfg.States))
 	if err != nil {
-		return nil, err
+		return nil, nil, fmt.Errorf("load content: %w", err)
 	}
-	var entries []FeedEntry
-	if err := json.Unmarshal(data, &entries); err != nil {
-		return nil, err
+	files, missing := collectPaths(cfg.ContentDir, items)
+	for _, it := range missing {
+		log.Printf("No MDX file for %s/%s under %s", it.Type, it.Slug, cfg.ContentDir)
 	}
-	slugs := make([]string, len(entries))
-	for i, e := range entries {
-		slugs[i] = e.Slug
+	if cfg.Since != "" {
+		changed, err := changedSince(cfg.ContentDir, cfg.Since)
+		if err != nil {
+			return nil, nil, fmt.Errorf("-since: %w", err)
+		}
+		files = filterChanged(files, changed)
+		fmt.Printf("%d content items, %d files changed since %s\n", len(items), len(files), cfg.Since)
+	} else {
+		fmt.Printf("%d content items, %d files to scan\n", len(items), len(files))
 	}
-	return slugs, nil
+	return items, files, nil
 }
 
-func collectPaths(root string, slugs []string) []string {
-	var paths []string
-	// Always include MDX and optional JSON in root
-	for _, slug := range slugs {
-		// assume path app/blog/YYYY/slug
-		// so walk root/*/slug
-		glob := filepath.Join(root, "*", slug)
-		dirs, _ := filepath.Glob(glob)
-		for _, dir := range dirs {
-			for _, fname := range []string{"page.mdx", "bibliography.json", "margin-notes.json"} {
-				fp := filepath.Join(dir, fname)
-				if _, err := os.Stat(fp); err == nil {
-					paths = append(paths, fp)
+// gatherRefs finds the source files to scan, extracts every URL reference,
+// rewrites each to its canonical form and applies the -policy file.
+func gatherRefs(cfg config) (refSet, error) {
+	_, files, err := contentFiles(cfg)
+	if err != nil {
+		return refSet{}, err
+	}
+	rules, err := loadNormalizeRules(cfg.NormalizeRules)
+	if err != nil {
+		return refSet{}, fmt.Errorf("load normalize rules: %w", err)
+	}
+	policy, err := loadPolicy(cfg.PolicyPath)
+	if err != nil {
+		return refSet{}, fmt.Errorf("load policy: %w", err)
+	}
+	policy.denyOwnSite(siteHost(cfg.SiteURL))
+	refs := extractRefs(files)
+	canonicalizeRefs(refs, rules)
+	set := refSet{Files: files}
+	set.Refs, set.Excluded, set.Always = applyPolicy(refs, policy)
+	if len(set.Excluded) > 0 {
+		fmt.Printf("%d URLs excluded by policy\n", len(set.Excluded))
+	}
+	return set, nil
+}
+
+// runArchive extracts URLs (or reloads an interrupted run), submits them to
+// every selected service and records the outcome in the ledger and report.
+func runArchive(ctx context.Context, cfg config) {
+	// Reject a bad -format now rather than after the run.
+	if _, err := reportFormat(cfg.ReportFormat, cfg.ReportPath); err != nil {
+		log.Fatalf("Invalid -format: %v", err)
+	}
+	ledger, err := openLedger(cfg.LedgerPath)
+	if err != nil {
+		log.Fatalf("Failed to open ledger: %v", err)
+	}
+	defer ledger.Close()
+
+	var runID int64
+	var pending []RunJob
+	var sources map[string][]URLRef
+	var excluded []Exclusion
+	var tracked map[string]bool
+	var cited []string
+	if cfg.Resume {
+		runID, pending, err = ledger.LastUnfinishedRun()
+		if err != nil {
+			log.Fatalf("Failed to read ledger: %v", err)
+		}
+		if runID == 0 {
+			fmt.Println("No interrupted run to resume.")
+			return
+		}
+		// Resume with the services the interrupted run was using.
+		cfg.Services = strings.Join(runServices(pending), ",")
+		cited = runURLs(pending)
+		fmt.Printf("Resuming run %d: %d jobs left\n", runID, len(pending))
+	}
+
+	// One limiter and robots.txt cache for the whole run, so the archivers,
+	// text snapshots and mirroring all honor the same Crawl-delays.
+	guard := newFetchGuard(cfg)
+	archivers, breakers, err := newArchivers(cfg, guard)
+	if err != nil {
+		log.Fatalf("Invalid -services: %v", err)
+	}
+	defer closeArchivers(archivers)
+	byName := make(map[string]Archiver, len(archivers))
+	for _, a := range archivers {
+		byName[a.Name()] = a
+	}
+
+	if !cfg.Resume {
+		// Collect files to scan and extract their canonical URLs
+		set, err := gatherRefs(cfg)
+		if err != nil {
+			log.Fatalf("Failed to collect URLs: %v", err)
+		}
+		sources = refsByURL(set.Refs)
+		excluded = set.Excluded
+		tracked = driftTracked(set.Refs, cfg.Drift)
+		urls := uniqueURLs(set.Refs)
+		cited = urls
+
+		// Skip URLs the ledger says are already archived recently enough,
+		// except those the policy wants archived every run
+		for _, a := range archivers {
+			due, err := ledger.Due(urls, a.Name(), cfg.MaxAge, time.Now())
+			if err != nil {
+				log.Fatalf("Failed to read ledger: %v", err)
+			}
+			isDue := make(map[string]bool, len(due))
+			for _, u := range due {
+				isDue[u] = true
+			}
+			for _, u := range urls {
+				if set.Always[u] && !isDue[u] {
+					due = append(due, u)
 				}
 			}
+			fmt.Printf("%s: %d URLs found, %d due for archiving\n", a.Name(), len(urls), len(due))
+			for _, u := range due {
+				pending = append(pending, RunJob{URL: u, Service: a.Name()})
+			}
+		}
+		runID, err = ledger.StartRun(pending, time.Now())
+		if err != nil {
+			log.Fatalf("Failed to start run: %v", err)
 		}
 	}
-	return paths
-}
 
-var urlRegex = regexp.MustCompile(`https?://[^\s"')>]+`)
+	jobs := make([]archiveJob, len(pending))
+	for i, p := range pending {
+		jobs[i] = archiveJob{URL: p.URL, Archiver: byName[p.Service]}
+	}
+
+	// Archive URLs, writing each outcome to the ledger as soon as it lands so
+	// an interrupted run loses nothing that already finished.
+	results := archiveURLs(ctx, jobs, cfg.Concurrency, func(r ArchiveResult) {
+		if err := ledger.Record(r, time.Now()); err != nil {
+			log.Printf("Ledger write error %s: %v", r.URL, err)
+		}
+		if err := ledger.MarkJobDone(runID, RunJob{URL: r.URL, Service: r.Service}); err != nil {
+			log.Printf("Ledger write error %s: %v", r.URL, err)
+		}
+	})
 
-func extractURLs(files []string) []string {
-	urlSet := make(map[string]struct{})
-	for _, f := range files {
-		data, err := os.ReadFile(f)
-		if err != nil {
-			log.Printf("Read error %s: %v", f, err)
-			continue
+	status := runComplete
+	left := len(jobs) - len(results)
+	if ctx.Err() != nil {
+		status = runInterrupted
+	}
+	if err := ledger.FinishRun(runID, status, time.Now()); err != nil {
+		log.Printf("Ledger write error: %v", err)
+	}
+	var skipped []Skip
+	if ctx.Err() == nil {
+		skipped = capturePages(ctx, cfg, guard, ledger, results, tracked)
+	}
+	// Documents are mirrored whether or not a service took them, since a
+	// failed submission is when a local copy matters most.
+	if ctx.Err() == nil && cfg.MirrorDir != "" {
+		stored, failed, blocked := mirrorDocuments(ctx, cfg, guard, ledger, cited)
+		if stored+failed > 0 {
+			fmt.Printf("Mirrored %d documents to %s (%d failed)\n", stored, cfg.MirrorDir, failed)
+		}
+		skipped = append(skipped, blocked...)
+		sortSkips(skipped)
+	}
+
+	// Write report
+	writeReport(cfg.ReportPath, cfg.ReportFormat, runReport{Results: results, Sources: sources, Excluded: excluded, Skipped: skipped, Breakers: breakers, Left: left})
+	if status == runInterrupted {
+		fmt.Printf("Interrupted with %d jobs left; rerun with -resume to finish. Report: %s\n", left, cfg.ReportPath)
+		return
+	}
+	fmt.Printf("Archive run complete. Report: %s\n", cfg.ReportPath)
+}
+
+// newArchivers builds the selected backends wrapped in rate limits, retries
+// and per-service circuit breakers.
+func newArchivers(cfg config, guard *fetchGuard) ([]Archiver, map[string]*circuitBreaker, error) {
+	backends, err := buildArchivers(cfg.Services, archiverOptions{
+		Client:     guard.client,
+		WARCDir:    cfg.WARCDir,
+		WaybackAPI: cfg.WaybackAPI,
+		Robots:     guard.robots,
+		Hosts:      guard.hosts,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	policy := retryPolicy{MaxAttempts: cfg.Retries, BaseDelay: 2 * time.Second, MaxDelay: 2 * time.Minute}
+	breakers := make(map[string]*circuitBreaker)
+	archivers := make([]Archiver, len(backends))
+	for i, b := range backends {
+		breakers[b.Name()] = newCircuitBreaker(cfg.BreakerThreshold, cfg.BreakerCooldown)
+		archivers[i] = &guardedArchiver{
+			Archiver: b,
+			service:  newTokenBucket(cfg.ServiceRate, 1),
+			hosts:    guard.hosts,
+			breaker:  breakers[b.Name()],
+			retry:    policy,
 		}
-		matches := urlRegex.FindAllString(string(data), -1)
-		for _, u := range matches {
-			urlSet[u] = struct{}{}
+	}
+	return archivers, breakers, nil
+}
+
+// runServices lists the distinct services named by jobs.
+func runServices(jobs []RunJob) []string {
+	seen := make(map[string]bool)
+	var names []string
+	for _, j := range jobs {
+		if !seen[j.Service] {
+			seen[j.Service] = true
+			names = append(names, j.Service)
 		}
 	}
-	urls := make([]string, 0, len(urlSet))
-	for u := range urlSet {
-		urls = append(urls, u)
+	sort.Strings(names)
+	return names
+}
+
+// runURLs lists the distinct URLs among jobs.
+func runURLs(jobs []RunJob) []string {
+	seen := make(map[string]bool)
+	var urls []string
+	for _, j := range jobs {
+		if !seen[j.URL] {
+			seen[j.URL] = true
+			urls = append(urls, j.URL)
+		}
 	}
+	sort.Strings(urls)
 	return urls
 }
 
-func archiveURLs(urls []string, concurrency int) []ArchiveResult {
-	eg, _ := errgroup.WithContext(context.Background())
+// archiveJob pairs a URL with the service it should be submitted to.
+type archiveJob struct {
+	URL      string
+	Archiver Archiver
+}
+
+// archiveURLs runs jobs with at most concurrency in flight, calling onResult
+// (serialised) as each finishes. Once ctx is cancelled no new jobs start and
+// jobs cut short by the cancellation are left out, so they stay pending.
+func archiveURLs(ctx context.Context, jobs []archiveJob, concurrency int, onResult func(ArchiveResult)) []ArchiveResult {
+	eg, egCtx := errgroup.WithContext(ctx)
 	sem := make(chan struct{}, concurrency)
 	var mu sync.Mutex
-	results := make([]ArchiveResult, 0, len(urls))
+	results := make([]ArchiveResult, 0, len(jobs))
 
-	for _, u := range urls {
-		u := u
-		sem <- struct{}{}
+dispatch:
+	for _, job := range jobs {
+		job := job
+		select {
+		case sem <- struct{}{}:
+		case <-egCtx.Done():
+			break dispatch
+		}
 		eg.Go(func() error {
 			defer func() { <-sem }()
-			// example: archive.org Save Page Now API
-			archived, err := savePageNow(u)
+			res := job.Archiver.Archive(egCtx, job.URL)
+			if egCtx.Err() != nil && !res.Archived {
+				return nil
+			}
 			mu.Lock()
-			results = append(results, ArchiveResult{URL: u, Service: "archive.org", Archived: archived, Error: err})
+			results = append(results, res)
+			onResult(res)
 			mu.Unlock()
 			return nil
 		})
@@ -162,25 +561,13 @@ func archiveURLs(urls []string, concurrency int) []ArchiveResult {
 	return results
 }
 
-func savePageNow(url string) (bool, error) {
-	api := "https://web.archive.org/save/" + url
-	client := http.Client{Timeout: 30 * time.Second}
-	resp, err := client.Get(api)
-	if err != nil {
-		return false, err
-	}
-	defer resp.Body.Close()
-	return resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusCreated, nil
-}
-
-func writeReport(path string, results []ArchiveResult) {
-	f, err := os.Create(path)
-	if err != nil {
-		log.Fatalf("Report create error: %v", err)
-	}
-	defer f.Close()
-	for _, r := range results {
-		line := fmt.Sprintf("%s [%s] archived=%t error=%v\n", r.URL, r.Service, r.Archived, r.Error)
-		f.WriteString(line)
+// closeArchivers releases backends that hold open files, such as warc.
+func closeArchivers(archivers []Archiver) {
+	for _, a := range archivers {
+		if c, ok := a.(io.Closer); ok {
+			if err := c.Close(); err != nil {
+				log.Printf("Close %s: %v", a.Name(), err)
+			}
+		}
 	}
 }